@@ -17,12 +17,15 @@ import (
 
 // exception for custom error
 type exception struct {
-	Code     string
-	Status   int
-	Message  string
-	Details  map[string]interface{}
-	GRPCCode codes.Code
-	_e       error
+	Code      string
+	Status    int
+	Message   string
+	Details   map[string]interface{}
+	GRPCCode  codes.Code
+	Origin    string // service that raised the error, see SetServiceName
+	RequestID string
+	Timestamp int64 // unix milliseconds when the error crossed the wire
+	_e        error
 }
 
 // ErrorView for client
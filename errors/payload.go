@@ -0,0 +1,10 @@
+package errors
+
+import (
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+)
+
+// ErrPayloadTooLarge 訊息大小超過上限, 例如 nats server 的 max_payload
+var ErrPayloadTooLarge = &exception{Code: "413001", Status: http.StatusRequestEntityTooLarge, Message: "payload too large", GRPCCode: codes.ResourceExhausted}
@@ -0,0 +1,66 @@
+package errors
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/pkg/errors"
+)
+
+// panicError keeps the recovered value and the stack of the panicking goroutine
+type panicError struct {
+	value interface{}
+	stack []byte
+}
+
+// Error implement error interface
+func (p *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", p.value)
+}
+
+// FromPanic converts a recovered value into an ErrInternal exception.
+// It must be called from the deferred function so the stack still holds the panicking frames.
+func FromPanic(r interface{}) error {
+	if r == nil {
+		return nil
+	}
+	_err := *ErrInternal
+	_err._e = &panicError{
+		value: r,
+		stack: debug.Stack(),
+	}
+	return &_err
+}
+
+// PanicValue returns the panic value and stack kept by FromPanic
+func PanicValue(err error) (value interface{}, stack []byte, ok bool) {
+	_err, ok := errors.Cause(err).(*exception)
+	if !ok {
+		return nil, nil, false
+	}
+	p, ok := _err._e.(*panicError)
+	if !ok {
+		return nil, nil, false
+	}
+	return p.value, p.stack, true
+}
+
+// Recover runs fn and returns its error, a panic in fn is returned as ErrInternal
+func Recover(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = FromPanic(r)
+		}
+	}()
+	return fn()
+}
+
+// Go runs fn in a new goroutine with Recover.
+// A non nil error is sent to errCh, which may be nil to drop the error.
+func Go(fn func() error, errCh chan<- error) {
+	go func() {
+		if err := Recover(fn); err != nil && errCh != nil {
+			errCh <- err
+		}
+	}()
+}
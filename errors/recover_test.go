@@ -0,0 +1,41 @@
+package errors
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecover(t *testing.T) {
+	err := Recover(func() error {
+		panic("boom")
+	})
+	assert.True(t, Is(err, ErrInternal))
+
+	v, stack, ok := PanicValue(err)
+	assert.True(t, ok)
+	assert.Equal(t, "boom", v)
+	assert.Contains(t, string(stack), "TestRecover")
+
+	err = Recover(func() error {
+		return ErrConflict
+	})
+	assert.Equal(t, ErrConflict, err)
+	_, _, ok = PanicValue(err)
+	assert.False(t, ok)
+}
+
+func TestGo(t *testing.T) {
+	errCh := make(chan error, 1)
+	Go(func() error {
+		var m map[string]int
+		m["a"] = 1
+		return nil
+	}, errCh)
+
+	err := <-errCh
+	assert.True(t, Is(err, ErrInternal))
+	v, _, ok := PanicValue(err)
+	assert.True(t, ok)
+	assert.Implements(t, (*error)(nil), v)
+}
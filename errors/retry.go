@@ -0,0 +1,29 @@
+package errors
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// IsRetryable reports whether the operation that returned err may succeed when retried:
+// server side exceptions (status 5xx) and errors that are not exceptions are retryable,
+// client side exceptions such as ErrInvalidInput or ErrResourceNotFound are not.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	e, ok := errors.Cause(err).(*exception)
+	if !ok {
+		return true
+	}
+	return e.Status >= http.StatusInternalServerError || e.Status == http.StatusTooManyRequests
+}
+
+// Code returns the exception code of err, ErrInternal's code when err is not an exception
+func Code(err error) string {
+	if e, ok := errors.Cause(err).(*exception); ok {
+		return e.Code
+	}
+	return ErrInternal.Code
+}
@@ -0,0 +1,20 @@
+package errors
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRetryable(t *testing.T) {
+	assert.False(t, IsRetryable(nil))
+	assert.True(t, IsRetryable(fmt.Errorf("connection reset")))
+	assert.True(t, IsRetryable(Wrapf(ErrInternal, "db is down")))
+	assert.False(t, IsRetryable(Wrapf(ErrInvalidInput, "bad id")))
+	assert.False(t, IsRetryable(ErrResourceNotFound))
+	assert.False(t, IsRetryable(Wrapf(ErrPayloadTooLarge, "2MB")))
+
+	assert.Equal(t, ErrConflict.Code, Code(Wrapf(ErrConflict, "exists")))
+	assert.Equal(t, ErrInternal.Code, Code(fmt.Errorf("boom")))
+}
@@ -0,0 +1,191 @@
+package errors
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+
+	traceRequestID "github.com/siangyeh8818/commonTools/trace/requestID"
+)
+
+const (
+	// WireVersionLegacy is the unversioned json.Marshal dump of exception
+	// sent by services before the envelope existed
+	WireVersionLegacy = 0
+	// WireVersion is the envelope schema version written by this package
+	WireVersion = 1
+
+	// wireMagic prefixes MarshalBinary output so it can be told apart from legacy json
+	wireMagic byte = 0xE7
+)
+
+var (
+	serviceMu   sync.RWMutex
+	serviceName string
+)
+
+// SetServiceName sets the origin written into every exception envelope
+func SetServiceName(name string) {
+	serviceMu.Lock()
+	serviceName = name
+	serviceMu.Unlock()
+}
+
+// ServiceName returns the origin set by SetServiceName
+func ServiceName() string {
+	serviceMu.RLock()
+	defer serviceMu.RUnlock()
+	return serviceName
+}
+
+// wireException is the versioned envelope of exception
+type wireException struct {
+	Version   int                    `json:"v"`
+	Code      string                 `json:"code"`
+	Status    int                    `json:"status"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	GRPCCode  codes.Code             `json:"grpc_code"`
+	Origin    string                 `json:"origin,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+	Timestamp int64                  `json:"timestamp,omitempty"`
+	Cause     string                 `json:"cause,omitempty"`
+}
+
+// legacyException is the payload of WireVersionLegacy
+type legacyException struct {
+	Code     string
+	Status   int
+	Message  string
+	Details  map[string]interface{}
+	GRPCCode codes.Code
+}
+
+// MarshalJSON encodes the exception with the current envelope version
+func (e *exception) MarshalJSON() ([]byte, error) {
+	w := wireException{
+		Version:   WireVersion,
+		Code:      e.Code,
+		Status:    e.Status,
+		Message:   e.Message,
+		Details:   e.Details,
+		GRPCCode:  e.GRPCCode,
+		Origin:    e.Origin,
+		RequestID: e.RequestID,
+		Timestamp: e.Timestamp,
+	}
+	if w.Origin == "" {
+		w.Origin = ServiceName()
+	}
+	if w.Timestamp == 0 {
+		w.Timestamp = time.Now().UTC().UnixNano() / 1e6
+	}
+	if e._e != nil {
+		w.Cause = e._e.Error()
+	}
+	return json.Marshal(w)
+}
+
+// UnmarshalJSON decodes an envelope of any known version, including legacy payloads
+func (e *exception) UnmarshalJSON(data []byte) error {
+	var probe struct {
+		Version *int `json:"v"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return err
+	}
+	if probe.Version == nil {
+		var l legacyException
+		if err := json.Unmarshal(data, &l); err != nil {
+			return err
+		}
+		*e = exception{
+			Code:     l.Code,
+			Status:   l.Status,
+			Message:  l.Message,
+			Details:  l.Details,
+			GRPCCode: l.GRPCCode,
+		}
+		return nil
+	}
+
+	// newer versions only add fields, so decode what this version knows about
+	var w wireException
+	if err := json.Unmarshal(data, &w); err != nil {
+		return err
+	}
+	*e = exception{
+		Code:      w.Code,
+		Status:    w.Status,
+		Message:   w.Message,
+		Details:   w.Details,
+		GRPCCode:  w.GRPCCode,
+		Origin:    w.Origin,
+		RequestID: w.RequestID,
+		Timestamp: w.Timestamp,
+	}
+	if w.Cause != "" {
+		e._e = errors.New(w.Cause)
+	}
+	return nil
+}
+
+// MarshalBinary encodes the exception as magic byte, version byte and the json envelope
+func (e *exception) MarshalBinary() ([]byte, error) {
+	b, err := e.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{wireMagic, WireVersion}, b...), nil
+}
+
+// UnmarshalBinary decodes MarshalBinary output, payloads without the magic byte are read as legacy json.
+// An unknown version byte is rejected with ErrInvalidInput.
+func (e *exception) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 || data[0] != wireMagic {
+		return e.UnmarshalJSON(data)
+	}
+	if data[1] != WireVersion {
+		return Wrapf(ErrInvalidInput, "unknown exception wire version %d", data[1])
+	}
+	return e.UnmarshalJSON(data[2:])
+}
+
+// WithContext stamps the request id of ctx onto err so it travels with the envelope.
+// Errors that are not exceptions are returned as they are.
+func WithContext(ctx context.Context, err error) error {
+	_e, ok := errors.Cause(err).(*exception)
+	if !ok {
+		return err
+	}
+	_err := *_e
+	_err.RequestID = traceRequestID.FromContext(ctx)
+	return &_err
+}
+
+// ToWire encodes err as the json envelope, errors that are not exceptions are sent as ErrInternal
+func ToWire(err error) ([]byte, error) {
+	if err == nil {
+		return nil, nil
+	}
+	_e, ok := errors.Cause(err).(*exception)
+	if !ok {
+		_err := *ErrInternal
+		_err._e = err
+		return _err.MarshalJSON()
+	}
+	return _e.MarshalJSON()
+}
+
+// FromWire decodes an envelope written by ToWire or MarshalBinary back to an exception
+func FromWire(data []byte) error {
+	_err := exception{}
+	if err := _err.UnmarshalBinary(data); err != nil {
+		return Wrapf(ErrInternal, "fail to decode exception, err: %s", err.Error())
+	}
+	return WithStack(&_err)
+}
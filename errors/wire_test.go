@@ -0,0 +1,127 @@
+package errors
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	traceRequestID "github.com/siangyeh8818/commonTools/trace/requestID"
+)
+
+func TestExceptionJSONRoundTrip(t *testing.T) {
+	SetServiceName("order-service")
+	defer SetServiceName("")
+
+	e := &exception{
+		Code:      "404001",
+		Status:    http.StatusNotFound,
+		Message:   "order not found",
+		Details:   map[string]interface{}{"order_id": "A1"},
+		GRPCCode:  codes.NotFound,
+		RequestID: "req-1",
+		Timestamp: 1514881707559,
+	}
+	b, err := json.Marshal(e)
+	assert.NoError(t, err)
+
+	got := exception{}
+	assert.NoError(t, json.Unmarshal(b, &got))
+	assert.Equal(t, e.Code, got.Code)
+	assert.Equal(t, e.Status, got.Status)
+	assert.Equal(t, e.Message, got.Message)
+	assert.Equal(t, e.Details, got.Details)
+	assert.Equal(t, e.GRPCCode, got.GRPCCode)
+	assert.Equal(t, "order-service", got.Origin)
+	assert.Equal(t, "req-1", got.RequestID)
+	assert.Equal(t, int64(1514881707559), got.Timestamp)
+}
+
+func TestExceptionBinaryRoundTrip(t *testing.T) {
+	e := Wrap(&exception{Code: "409001", Status: http.StatusConflict, Message: "conflict", GRPCCode: codes.AlreadyExists}, "duplicate key")
+	b, err := e.(*exception).MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, wireMagic, b[0])
+	assert.Equal(t, byte(WireVersion), b[1])
+
+	got := exception{}
+	assert.NoError(t, got.UnmarshalBinary(b))
+	assert.Equal(t, "409001", got.Code)
+	assert.NotZero(t, got.Timestamp)
+	assert.Equal(t, e.Error(), got.Error())
+
+	for _, version := range []byte{WireVersionLegacy, WireVersion + 1, 0xFF} {
+		b[1] = version
+		err := (&exception{}).UnmarshalBinary(b)
+		assert.True(t, Is(err, ErrInvalidInput), "version %d", version)
+	}
+	assert.True(t, Is(FromWire(b), ErrInternal))
+}
+
+func TestExceptionDecodeOlderVersions(t *testing.T) {
+	tests := []struct {
+		Description string
+		Payload     string
+		Expect      exception
+	}{
+		{
+			"legacy payload from json.Marshal of the struct",
+			`{"Code":"404001","Status":404,"Message":"not found","Details":{"id":"1"},"GRPCCode":5}`,
+			exception{Code: "404001", Status: 404, Message: "not found", Details: map[string]interface{}{"id": "1"}, GRPCCode: codes.NotFound},
+		},
+		{
+			"legacy payload without details",
+			`{"Code":"500001","Status":500,"Message":"internal error","Details":null,"GRPCCode":13}`,
+			exception{Code: "500001", Status: 500, Message: "internal error", GRPCCode: codes.Internal},
+		},
+		{
+			"version 1 envelope",
+			`{"v":1,"code":"400001","status":400,"message":"bad","grpc_code":3,"origin":"a","request_id":"r","timestamp":1}`,
+			exception{Code: "400001", Status: 400, Message: "bad", GRPCCode: codes.InvalidArgument, Origin: "a", RequestID: "r", Timestamp: 1},
+		},
+		{
+			"newer envelope with unknown fields",
+			`{"v":9,"code":"400001","status":400,"message":"bad","grpc_code":3,"unknown":true}`,
+			exception{Code: "400001", Status: 400, Message: "bad", GRPCCode: codes.InvalidArgument},
+		},
+	}
+	for _, test := range tests {
+		got := exception{}
+		assert.NoError(t, got.UnmarshalBinary([]byte(test.Payload)), test.Description)
+		assert.Equal(t, test.Expect, got, test.Description)
+	}
+}
+
+func TestConvertProtoErrEnvelope(t *testing.T) {
+	ctx := traceRequestID.ContextWithXRequestID(context.Background(), "req-2")
+	e := WithContext(ctx, &exception{Code: "403001", Status: http.StatusForbidden, Message: "not allowed", GRPCCode: codes.PermissionDenied})
+
+	grpcErr := ConvertProtoErr(e)
+	assert.Equal(t, codes.PermissionDenied, status.Code(grpcErr))
+
+	got, ok := ConvertHttpErr(grpcErr).(interface{ Cause() error }).Cause().(*exception)
+	assert.True(t, ok)
+	assert.Equal(t, "403001", got.Code)
+	assert.Equal(t, "req-2", got.RequestID)
+}
+
+func TestWire(t *testing.T) {
+	b, err := ToWire(Wrap(&exception{Code: "404001", Status: http.StatusNotFound, Message: "not found", GRPCCode: codes.NotFound}, "order A1"))
+	assert.NoError(t, err)
+	got := FromWire(b)
+	assert.True(t, Is(got, &exception{Code: "404001"}))
+	assert.Contains(t, got.Error(), "order A1")
+
+	b, err = ToWire(fmt.Errorf("dial tcp: timeout"))
+	assert.NoError(t, err)
+	got = FromWire(b)
+	assert.True(t, Is(got, ErrInternal))
+	assert.Contains(t, got.Error(), "dial tcp: timeout")
+
+	assert.True(t, Is(FromWire([]byte("not json")), ErrInternal))
+}
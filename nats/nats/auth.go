@@ -0,0 +1,141 @@
+package nats
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+const (
+	secretEnvPrefix  = "env:"
+	secretFilePrefix = "file:"
+)
+
+// TLSConfig for nats client, CertFile and KeyFile enable mutual TLS
+type TLSConfig struct {
+	CAFile             string `mapstructure:"ca_file" yaml:"ca_file"`
+	CertFile           string `mapstructure:"cert_file" yaml:"cert_file"`
+	KeyFile            string `mapstructure:"key_file" yaml:"key_file"`
+	ServerName         string `mapstructure:"server_name" yaml:"server_name"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify" yaml:"insecure_skip_verify"` // 只在開發環境使用
+}
+
+// enabled reports whether any TLS setting is given
+func (t TLSConfig) enabled() bool {
+	return t.CAFile != "" || t.CertFile != "" || t.KeyFile != "" || t.ServerName != "" || t.InsecureSkipVerify
+}
+
+// resolveSecret reads a secret given as "env:NAME", "file:/path" or as the plain value
+func resolveSecret(field, value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretEnvPrefix):
+		name := strings.TrimPrefix(value, secretEnvPrefix)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.Wrapf(errors.ErrInvalidInput, "nats config: %s refers to environment variable %s which is not set", field, name)
+		}
+		return v, nil
+	case strings.HasPrefix(value, secretFilePrefix):
+		path := strings.TrimPrefix(value, secretFilePrefix)
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", errors.Wrapf(errors.ErrInvalidInput, "nats config: %s fail to read file %s, err: %s", field, path, err.Error())
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return value, nil
+}
+
+// authOptions validates the auth and TLS settings of c and returns them as nats options
+func authOptions(c *Config) ([]nats.Option, error) {
+	var methods []string
+	if c.Account != "" || c.Password != "" {
+		methods = append(methods, "account/password")
+	}
+	if c.Token != "" {
+		methods = append(methods, "token")
+	}
+	if c.NKeySeedFile != "" {
+		methods = append(methods, "nkey_seed_file")
+	}
+	if c.CredsFile != "" {
+		methods = append(methods, "creds_file")
+	}
+	if len(methods) > 1 {
+		return nil, errors.Wrapf(errors.ErrInvalidInput, "nats config: only one auth method can be set, got %s", strings.Join(methods, ", "))
+	}
+
+	var opts []nats.Option
+	switch {
+	case c.Account != "" || c.Password != "":
+		if c.Account == "" {
+			return nil, errors.Wrapf(errors.ErrInvalidInput, "nats config: password is set without account")
+		}
+		password, err := resolveSecret("password", c.Password)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, nats.UserInfo(c.Account, password))
+	case c.Token != "":
+		token, err := resolveSecret("token", c.Token)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, nats.Token(token))
+	case c.NKeySeedFile != "":
+		opt, err := nats.NkeyOptionFromSeed(c.NKeySeedFile)
+		if err != nil {
+			return nil, errors.Wrapf(errors.ErrInvalidInput, "nats config: nkey_seed_file %s is invalid, err: %s", c.NKeySeedFile, err.Error())
+		}
+		opts = append(opts, opt)
+	case c.CredsFile != "":
+		if _, err := os.Stat(c.CredsFile); err != nil {
+			return nil, errors.Wrapf(errors.ErrInvalidInput, "nats config: creds_file %s is not readable, err: %s", c.CredsFile, err.Error())
+		}
+		opts = append(opts, nats.UserCredentials(c.CredsFile))
+	}
+
+	if c.TLS.enabled() {
+		tlsConfig, err := newTLSConfig(c.TLS)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, nats.Secure(tlsConfig))
+	}
+	return opts, nil
+}
+
+func newTLSConfig(t TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, errors.Wrapf(errors.ErrInvalidInput, "nats config: tls ca_file %s is not readable, err: %s", t.CAFile, err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Wrapf(errors.ErrInvalidInput, "nats config: tls ca_file %s has no PEM certificate", t.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return nil, errors.Wrapf(errors.ErrInvalidInput, "nats config: tls cert_file and key_file must be set together")
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(errors.ErrInvalidInput, "nats config: tls cert_file %s or key_file %s is invalid, err: %s", t.CertFile, t.KeyFile, err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
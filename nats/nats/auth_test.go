@@ -0,0 +1,155 @@
+package nats
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+func TestResolveSecret(t *testing.T) {
+	t.Setenv("NATS_TEST_TOKEN", "from-env")
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, ioutil.WriteFile(path, []byte("from-file\n"), 0600))
+
+	v, err := resolveSecret("token", "env:NATS_TEST_TOKEN")
+	assert.NoError(t, err)
+	assert.Equal(t, "from-env", v)
+
+	v, err = resolveSecret("token", "file:"+path)
+	assert.NoError(t, err)
+	assert.Equal(t, "from-file", v)
+
+	v, err = resolveSecret("token", "plain")
+	assert.NoError(t, err)
+	assert.Equal(t, "plain", v)
+
+	_, err = resolveSecret("token", "env:NATS_TEST_MISSING")
+	assert.True(t, errors.Is(err, errors.ErrInvalidInput))
+	assert.Contains(t, err.Error(), "NATS_TEST_MISSING")
+}
+
+func TestAuthOptionsValidation(t *testing.T) {
+	tests := []struct {
+		Description string
+		Config      Config
+		Contains    string
+	}{
+		{"two auth methods", Config{Account: "a", Password: "p", Token: "t"}, "only one auth method"},
+		{"password without account", Config{Password: "p"}, "password is set without account"},
+		{"missing creds file", Config{CredsFile: "/not/exist.creds"}, "creds_file"},
+		{"missing nkey seed", Config{NKeySeedFile: "/not/exist.nk"}, "nkey_seed_file"},
+		{"cert without key", Config{TLS: TLSConfig{CertFile: "cert.pem"}}, "cert_file and key_file"},
+		{"missing ca file", Config{TLS: TLSConfig{CAFile: "/not/exist.pem"}}, "ca_file"},
+	}
+	for _, test := range tests {
+		_, err := authOptions(&test.Config)
+		assert.True(t, errors.Is(err, errors.ErrInvalidInput), test.Description)
+		assert.Contains(t, err.Error(), test.Contains, test.Description)
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.Authorization = "s3cr3t"
+	s := natsserver.RunServer(&opts)
+	defer s.Shutdown()
+
+	t.Setenv("NATS_TEST_TOKEN", "s3cr3t")
+	c, err := NewClient(&Config{Address: []string{s.ClientURL()}, Token: "env:NATS_TEST_TOKEN"})
+	require.NoError(t, err)
+	assert.NoError(t, c.Close(context.Background()))
+
+	_, err = NewClient(&Config{Address: []string{s.ClientURL()}, Token: "wrong"})
+	assert.Error(t, err)
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	caCert, caKey := newCert(t, dir, "ca", nil, nil)
+	newCert(t, dir, "server", caCert, caKey)
+	newCert(t, dir, "client", caCert, caKey)
+
+	serverTLS, err := newTLSConfig(TLSConfig{
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+	})
+	require.NoError(t, err)
+	serverTLS.ClientCAs = serverTLS.RootCAs
+	serverTLS.ClientAuth = tls.RequireAndVerifyClientCert
+
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.TLS = true
+	opts.TLSVerify = true
+	opts.TLSConfig = serverTLS
+	s := natsserver.RunServer(&opts)
+	defer s.Shutdown()
+
+	c, err := NewClient(&Config{
+		Address: []string{s.ClientURL()},
+		TLS: TLSConfig{
+			CAFile:   filepath.Join(dir, "ca.pem"),
+			CertFile: filepath.Join(dir, "client.pem"),
+			KeyFile:  filepath.Join(dir, "client-key.pem"),
+		},
+	})
+	require.NoError(t, err)
+	assert.NoError(t, c.Close(context.Background()))
+
+	_, err = NewClient(&Config{
+		Address: []string{s.ClientURL()},
+		TLS:     TLSConfig{CAFile: filepath.Join(dir, "ca.pem")},
+	})
+	assert.Error(t, err)
+}
+
+// newCert writes name.pem and name-key.pem into dir, signed by parent or self-signed as a CA
+func newCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return cert, key
+}
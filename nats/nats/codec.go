@@ -0,0 +1,172 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/nats-io/nats.go"
+	"github.com/siangyeh8818/commonTools/errors"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// HeaderContentType selects the codec of the message data
+	HeaderContentType = "Content-Type"
+
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/protobuf"
+	ContentTypeMsgpack  = "application/msgpack"
+)
+
+var (
+	codecMu sync.RWMutex
+	codecs  = map[string]Codec{
+		ContentTypeJSON:     jsonCodec{},
+		ContentTypeProtobuf: protobufCodec{},
+		ContentTypeMsgpack:  msgpackCodec{},
+	}
+
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Codec encodes and decodes message data of one content type
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// RegisterCodec adds or replaces the codec of its content type
+func RegisterCodec(codec Codec) {
+	codecMu.Lock()
+	codecs[codec.ContentType()] = codec
+	codecMu.Unlock()
+}
+
+// GetCodec returns the codec registered for contentType
+func GetCodec(contentType string) (Codec, bool) {
+	codecMu.RLock()
+	defer codecMu.RUnlock()
+	codec, ok := codecs[contentType]
+	return codec, ok
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return ContentTypeJSON }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string { return ContentTypeProtobuf }
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	pm, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a proto.Message", v)
+	}
+	return proto.Marshal(pm)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	pm, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not a proto.Message", v)
+	}
+	return proto.Unmarshal(data, pm)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string { return ContentTypeMsgpack }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) { return msgpack.Marshal(v) }
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error { return msgpack.Unmarshal(data, v) }
+
+// codecKey holds the codec lookup of the client in the handler context, see Typed
+type codecKey struct{}
+
+// codec returns the codec of WithCodec for contentType, or the registered one
+func (c *Client) codec(contentType string) (Codec, bool) {
+	if codec, ok := c.codecs[contentType]; ok {
+		return codec, true
+	}
+	return GetCodec(contentType)
+}
+
+// Decode unmarshals msg data into v with the registered codec of its Content-Type header, json when the header is missing.
+// The codecs of WithCodec are only known by Typed handlers.
+func Decode(msg *nats.Msg, v interface{}) error {
+	return decode(msg, v, GetCodec)
+}
+
+func decode(msg *nats.Msg, v interface{}, lookup func(contentType string) (Codec, bool)) error {
+	contentType := msg.Header.Get(HeaderContentType)
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+	codec, ok := lookup(contentType)
+	if !ok {
+		return errors.Wrapf(errors.ErrInvalidInput, "unknown content type %s", contentType)
+	}
+	if err := codec.Unmarshal(msg.Data, v); err != nil {
+		return errors.Wrapf(errors.ErrInvalidInput, "fail to decode %s, err: %s", contentType, err.Error())
+	}
+	return nil
+}
+
+// Typed adapts fn of type func(ctx context.Context, v *T) error to a Channel handler.
+// The message is decoded into a new T with the codecs of the client before fn runs, decode failures are
+// returned as ErrInvalidInput without calling fn. Typed panics when fn has another signature.
+func Typed(fn interface{}) func(ctx context.Context, msg *nats.Msg) error {
+	fv := reflect.ValueOf(fn)
+	ft := fv.Type()
+	if ft.Kind() != reflect.Func || ft.NumIn() != 2 || ft.NumOut() != 1 ||
+		ft.In(0) != contextType || ft.In(1).Kind() != reflect.Ptr || ft.Out(0) != errorType {
+		panic(fmt.Sprintf("nats: Typed needs func(context.Context, *T) error, got %s", ft))
+	}
+	elem := ft.In(1).Elem()
+
+	return func(ctx context.Context, msg *nats.Msg) error {
+		lookup, ok := ctx.Value(codecKey{}).(func(contentType string) (Codec, bool))
+		if !ok {
+			lookup = GetCodec
+		}
+		v := reflect.New(elem)
+		if err := decode(msg, v.Interface(), lookup); err != nil {
+			return err
+		}
+		out := fv.Call([]reflect.Value{reflect.ValueOf(&ctx).Elem(), v})
+		err, _ := out[0].Interface().(error)
+		return err
+	}
+}
+
+// PubTyped 以 WithCodec 或 Config.ContentType 的 codec 編碼 v 後推送
+func (c *Client) PubTyped(ctx context.Context, subject string, v interface{}) error {
+	contentType := c.contentType
+	if contentType == "" {
+		contentType = c.cfg.ContentType
+	}
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+	codec, ok := c.codec(contentType)
+	if !ok {
+		return errors.Wrapf(errors.ErrInvalidInput, "unknown content type %s", contentType)
+	}
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return errors.Wrapf(errors.ErrInvalidInput, "fail to encode %s, err: %s", contentType, err.Error())
+	}
+	return c.Pub(ctx, subject, map[string][]string{HeaderContentType: {contentType}}, data)
+}
@@ -0,0 +1,121 @@
+package nats
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+type orderCreated struct {
+	OrderID string `json:"order_id" msgpack:"order_id"`
+	Amount  int64  `json:"amount" msgpack:"amount"`
+}
+
+func TestTypedHandler(t *testing.T) {
+	for _, contentType := range []string{ContentTypeJSON, ContentTypeMsgpack} {
+		c := newTestClient(t)
+		c.cfg.ContentType = contentType
+
+		got := make(chan *orderCreated, 1)
+		_, err := c.RegisterChannel([]Channel{{
+			ChannelName: "orders.created",
+			Handler: Typed(func(ctx context.Context, v *orderCreated) error {
+				got <- v
+				return nil
+			}),
+		}})
+		require.NoError(t, err)
+
+		require.NoError(t, c.PubTyped(context.Background(), "orders.created", &orderCreated{OrderID: "A1", Amount: 100}))
+		select {
+		case v := <-got:
+			assert.Equal(t, &orderCreated{OrderID: "A1", Amount: 100}, v, contentType)
+		case <-time.After(5 * time.Second):
+			t.Fatal("message was not handled", contentType)
+		}
+	}
+}
+
+func TestTypedProtobuf(t *testing.T) {
+	codec, ok := GetCodec(ContentTypeProtobuf)
+	require.True(t, ok)
+	data, err := codec.Marshal(wrapperspb.String("A1"))
+	require.NoError(t, err)
+
+	var got string
+	handler := Typed(func(ctx context.Context, v *wrapperspb.StringValue) error {
+		got = v.GetValue()
+		return nil
+	})
+	msg := &nats.Msg{Header: nats.Header{HeaderContentType: {ContentTypeProtobuf}}, Data: data}
+	assert.NoError(t, handler(context.Background(), msg))
+	assert.Equal(t, "A1", got)
+}
+
+func TestTypedDecodeError(t *testing.T) {
+	called := false
+	handler := Typed(func(ctx context.Context, v *orderCreated) error {
+		called = true
+		return nil
+	})
+
+	err := handler(context.Background(), &nats.Msg{Data: []byte("{")})
+	assert.True(t, errors.Is(err, errors.ErrInvalidInput))
+
+	err = handler(context.Background(), &nats.Msg{Header: nats.Header{HeaderContentType: {"text/xml"}}, Data: []byte("<a/>")})
+	assert.True(t, errors.Is(err, errors.ErrInvalidInput))
+	assert.False(t, called)
+
+	assert.Panics(t, func() {
+		Typed(func(v *orderCreated) error { return nil })
+	})
+}
+
+func TestWithCodecIsPerClient(t *testing.T) {
+	s := runServer(t, false)
+	c, err := NewClient(&Config{Address: []string{s.ClientURL()}}, WithCodec(upperCodec{}))
+	require.NoError(t, err)
+	defer c.Close(context.Background())
+	other, err := NewClient(&Config{Address: []string{s.ClientURL()}})
+	require.NoError(t, err)
+	defer other.Close(context.Background())
+
+	_, ok := GetCodec("text/upper")
+	assert.False(t, ok)
+	assert.Equal(t, ContentTypeJSON, c.cfg.ContentType)
+
+	got := make(chan string, 1)
+	_, err = c.Sub("codec.upper", Typed(func(ctx context.Context, v *string) error {
+		got <- *v
+		return nil
+	}))
+	require.NoError(t, err)
+	failed := make(chan error, 1)
+	_, err = other.Sub("codec.upper", func(ctx context.Context, msg *nats.Msg) error {
+		failed <- Typed(func(ctx context.Context, v *string) error { return nil })(ctx, msg)
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, other.natsConn.Flush())
+
+	require.NoError(t, c.PubTyped(context.Background(), "codec.upper", "hello"))
+	select {
+	case v := <-got:
+		assert.Equal(t, "HELLO", v)
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not handled by the client with the codec")
+	}
+	select {
+	case err := <-failed:
+		assert.True(t, errors.Is(err, errors.ErrInvalidInput), err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not handled by the other client")
+	}
+}
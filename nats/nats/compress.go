@@ -0,0 +1,170 @@
+package nats
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nats-io/nats.go"
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+const (
+	// HeaderContentEncoding is the compression of the message data, set by Pub above CompressionConfig.Threshold
+	HeaderContentEncoding = "Content-Encoding"
+
+	EncodingGzip   = "gzip"
+	EncodingSnappy = "snappy" // snappy block format
+	EncodingZstd   = "zstd"
+
+	DefaultCompressionThreshold = 32 * 1024
+	DefaultMaxDecompressedSize  = 64 * 1024 * 1024
+)
+
+// CompressionConfig Pub 壓縮超過 Threshold bytes 的訊息, 收到有 Content-Encoding header 的訊息會在 Handler 前解壓縮
+type CompressionConfig struct {
+	Encoding            string `mapstructure:"encoding" yaml:"encoding"`                           // gzip, snappy 或 zstd, 空白不壓縮
+	Threshold           int    `mapstructure:"threshold" yaml:"threshold"`                         // 預設 DefaultCompressionThreshold
+	MaxDecompressedSize int    `mapstructure:"max_decompressed_size" yaml:"max_decompressed_size"` // 解壓縮後超過時拒絕訊息, 預設 DefaultMaxDecompressedSize
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder // EncodeAll is safe for concurrent use
+)
+
+func validEncoding(encoding string) bool {
+	switch encoding {
+	case EncodingGzip, EncodingSnappy, EncodingZstd:
+		return true
+	}
+	return false
+}
+
+// compress replaces the data of msg by its compressed form when it is over the threshold and gets smaller
+func (c *Client) compress(msg *nats.Msg) error {
+	cc := c.cfg.Compression
+	if cc.Encoding == "" || len(msg.Data) < cc.Threshold || msg.Header.Get(HeaderContentEncoding) != "" {
+		return nil
+	}
+
+	var data []byte
+	switch cc.Encoding {
+	case EncodingGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(msg.Data); err != nil {
+			return errors.Wrapf(errors.ErrInternal, "fail to gzip message, err: %s", err.Error())
+		}
+		if err := w.Close(); err != nil {
+			return errors.Wrapf(errors.ErrInternal, "fail to gzip message, err: %s", err.Error())
+		}
+		data = buf.Bytes()
+	case EncodingSnappy:
+		data = s2.EncodeSnappy(nil, msg.Data)
+	case EncodingZstd:
+		zstdOnce.Do(func() { zstdEncoder, _ = zstd.NewWriter(nil) })
+		data = zstdEncoder.EncodeAll(msg.Data, nil)
+	}
+	if len(data) >= len(msg.Data) {
+		return nil
+	}
+	msg.Data = data
+	msg.Header.Set(HeaderContentEncoding, cc.Encoding)
+	return nil
+}
+
+// decompress replaces the data of msg by its decompressed form and removes the Content-Encoding header.
+// Unknown encodings and corrupted data are ErrInvalidInput, data over CompressionConfig.MaxDecompressedSize is ErrPayloadTooLarge.
+func (c *Client) decompress(msg *nats.Msg) error {
+	encoding := msg.Header.Get(HeaderContentEncoding)
+	if encoding == "" {
+		return nil
+	}
+	limit := c.cfg.Compression.MaxDecompressedSize
+
+	var r io.Reader
+	switch encoding {
+	case EncodingGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(msg.Data))
+		if err != nil {
+			return errors.Wrapf(errors.ErrInvalidInput, "fail to gunzip message on %s, err: %s", msg.Subject, err.Error())
+		}
+		defer gr.Close()
+		r = gr
+	case EncodingSnappy:
+		n, err := s2.DecodedLen(msg.Data)
+		if err != nil {
+			return errors.Wrapf(errors.ErrInvalidInput, "fail to decode snappy message on %s, err: %s", msg.Subject, err.Error())
+		}
+		if n > limit {
+			return tooLargeDecompressed(msg, limit)
+		}
+		data, err := s2.Decode(nil, msg.Data)
+		if err != nil {
+			return errors.Wrapf(errors.ErrInvalidInput, "fail to decode snappy message on %s, err: %s", msg.Subject, err.Error())
+		}
+		return setDecompressed(msg, data)
+	case EncodingZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(msg.Data), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return errors.Wrapf(errors.ErrInvalidInput, "fail to decode zstd message on %s, err: %s", msg.Subject, err.Error())
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return errors.Wrapf(errors.ErrInvalidInput, "unknown content encoding %s on %s", encoding, msg.Subject)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return errors.Wrapf(errors.ErrInvalidInput, "fail to decode %s message on %s, err: %s", encoding, msg.Subject, err.Error())
+	}
+	if len(data) > limit {
+		return tooLargeDecompressed(msg, limit)
+	}
+	return setDecompressed(msg, data)
+}
+
+func setDecompressed(msg *nats.Msg, data []byte) error {
+	msg.Data = data
+	msg.Header.Del(HeaderContentEncoding)
+	return nil
+}
+
+func tooLargeDecompressed(msg *nats.Msg, limit int) error {
+	return errors.Wrapf(errors.ErrPayloadTooLarge, "message on %s is over %d bytes once decompressed", msg.Subject, limit)
+}
+
+// checkPayload rejects msg when its data and headers are over the max_payload of the server,
+// nats would fail the publish with a generic error
+func (c *Client) checkPayload(msg *nats.Msg) error {
+	max := c.natsConn.MaxPayload()
+	if max <= 0 {
+		// not connected yet
+		return nil
+	}
+	size := int64(len(msg.Data) + headerSize(msg.Header))
+	if size > max {
+		return errors.Wrapf(errors.ErrPayloadTooLarge, "message to %s is %d bytes, over the max_payload %d of the server", msg.Subject, size, max)
+	}
+	return nil
+}
+
+// headerSize is the size of h in the nats wire format
+func headerSize(h nats.Header) int {
+	if len(h) == 0 {
+		return 0
+	}
+	size := len("NATS/1.0\r\n\r\n")
+	for k, vs := range h {
+		for _, v := range vs {
+			size += len(k) + len(": ") + len(v) + len("\r\n")
+		}
+	}
+	return size
+}
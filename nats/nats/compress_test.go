@@ -0,0 +1,168 @@
+package nats
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+func TestCompression(t *testing.T) {
+	s := runServer(t, false)
+	payload := bytes.Repeat([]byte("event payload "), 5000)
+
+	for _, encoding := range []string{EncodingGzip, EncodingSnappy, EncodingZstd} {
+		t.Run(encoding, func(t *testing.T) {
+			c, err := NewClient(&Config{Address: []string{s.ClientURL()}}, WithCompression(encoding, 1024))
+			require.NoError(t, err)
+			defer c.Close(context.Background())
+			raw := subscribeRaw(t, s.ClientURL(), "compress."+encoding)
+
+			got := make(chan *nats.Msg, 1)
+			_, err = c.Sub("compress."+encoding, func(ctx context.Context, msg *nats.Msg) error {
+				got <- msg
+				return nil
+			})
+			require.NoError(t, err)
+			require.NoError(t, c.Pub(context.Background(), "compress."+encoding, nil, payload))
+
+			wire, err := raw.NextMsg(time.Second)
+			require.NoError(t, err)
+			assert.Equal(t, encoding, wire.Header.Get(HeaderContentEncoding))
+			assert.Less(t, len(wire.Data), len(payload)/10)
+
+			select {
+			case msg := <-got:
+				assert.Equal(t, payload, msg.Data)
+				assert.Empty(t, msg.Header.Get(HeaderContentEncoding))
+			case <-time.After(2 * time.Second):
+				t.Fatal("message not handled")
+			}
+		})
+	}
+}
+
+func TestCompressionSkipped(t *testing.T) {
+	s := runServer(t, false)
+	c, err := NewClient(&Config{Address: []string{s.ClientURL()}}, WithCompression(EncodingGzip, 1024))
+	require.NoError(t, err)
+	defer c.Close(context.Background())
+	raw := subscribeRaw(t, s.ClientURL(), "compress.skip")
+
+	random := make([]byte, 4096)
+	_, _ = rand.Read(random)
+	for _, data := range [][]byte{bytes.Repeat([]byte("a"), 1000), random} {
+		require.NoError(t, c.Pub(context.Background(), "compress.skip", nil, data))
+		wire, err := raw.NextMsg(time.Second)
+		require.NoError(t, err)
+		assert.Empty(t, wire.Header.Get(HeaderContentEncoding))
+		assert.Equal(t, data, wire.Data)
+	}
+}
+
+func TestPayloadTooLarge(t *testing.T) {
+	s := runServer(t, false)
+	plain := newTestClient(t)
+	compressed, err := NewClient(&Config{Address: []string{s.ClientURL()}}, WithCompression(EncodingZstd, 0))
+	require.NoError(t, err)
+	defer compressed.Close(context.Background())
+
+	large := bytes.Repeat([]byte("x"), int(plain.natsConn.MaxPayload())+1)
+	err = plain.Pub(context.Background(), "large", nil, large)
+	assert.True(t, errors.Is(err, errors.ErrPayloadTooLarge), err)
+	assert.Contains(t, err.Error(), "max_payload")
+	assert.False(t, errors.IsRetryable(err))
+
+	batch := []*nats.Msg{{Subject: "large", Data: []byte("small")}, {Subject: "large", Data: large}}
+	err = plain.PubBatch(context.Background(), batch)
+	assert.True(t, errors.Is(err, errors.ErrPayloadTooLarge), err)
+	assert.Contains(t, err.Error(), "batch stopped at message 2 of 2")
+	assert.False(t, errors.IsRetryable(err))
+
+	assert.NoError(t, compressed.Pub(context.Background(), "large", nil, large))
+	assert.NoError(t, compressed.PubBatch(context.Background(), batch))
+
+	// incompressible data stays over the limit with compression
+	random := make([]byte, len(large))
+	_, _ = rand.Read(random)
+	err = compressed.Pub(context.Background(), "large", nil, random)
+	assert.True(t, errors.Is(err, errors.ErrPayloadTooLarge), err)
+	err = compressed.PubBatch(context.Background(), []*nats.Msg{{Subject: "large", Data: random}})
+	assert.True(t, errors.Is(err, errors.ErrPayloadTooLarge), err)
+}
+
+func TestDecompressErrors(t *testing.T) {
+	c, err := NewClient(&Config{Address: []string{"nats://127.0.0.1:4222"}, ConnectMode: ConnectModeLazy})
+	require.NoError(t, err)
+	defer c.Close(context.Background())
+	c.cfg.Compression = CompressionConfig{Encoding: EncodingGzip, MaxDecompressedSize: 1024}
+
+	unknown := &nats.Msg{Subject: "a", Header: nats.Header{HeaderContentEncoding: {"br"}}, Data: []byte("x")}
+	assert.True(t, errors.Is(c.decompress(unknown), errors.ErrInvalidInput))
+
+	for _, encoding := range []string{EncodingGzip, EncodingSnappy, EncodingZstd} {
+		corrupted := &nats.Msg{Subject: "a", Header: nats.Header{HeaderContentEncoding: {encoding}}, Data: []byte("not compressed")}
+		assert.True(t, errors.Is(c.decompress(corrupted), errors.ErrInvalidInput), encoding)
+
+		c.cfg.Compression.Encoding = encoding
+		bomb := &nats.Msg{Subject: "a", Header: nats.Header{}, Data: make([]byte, 4096)}
+		require.NoError(t, c.compress(bomb))
+		require.Equal(t, encoding, bomb.Header.Get(HeaderContentEncoding))
+		assert.True(t, errors.Is(c.decompress(bomb), errors.ErrPayloadTooLarge), encoding)
+	}
+}
+
+func TestCorruptedMessageSkipsHandler(t *testing.T) {
+	c := newTestClient(t)
+	called := make(chan struct{}, 1)
+	_, err := c.Sub("compress.corrupted", func(ctx context.Context, msg *nats.Msg) error {
+		called <- struct{}{}
+		return nil
+	})
+	require.NoError(t, err)
+
+	header := map[string][]string{HeaderContentEncoding: {EncodingGzip}}
+	require.NoError(t, c.Pub(context.Background(), "compress.corrupted", header, []byte("not gzip")))
+	select {
+	case <-called:
+		t.Fatal("handler called with corrupted data")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCompressedRequest(t *testing.T) {
+	s := runServer(t, false)
+	c, err := NewClient(&Config{Address: []string{s.ClientURL()}}, WithCompression(EncodingSnappy, 1024))
+	require.NoError(t, err)
+	defer c.Close(context.Background())
+
+	payload := bytes.Repeat([]byte("reply "), 1000)
+	require.NoError(t, c.RegisterResponder([]Responder{{
+		ChannelName: "compress.request",
+		Handler: func(ctx context.Context, msg *nats.Msg) ([]byte, error) {
+			return append(msg.Data, payload...), nil
+		},
+	}}))
+
+	reply, err := c.Request(context.Background(), "compress.request", nil, payload)
+	require.NoError(t, err)
+	assert.Equal(t, append(append([]byte(nil), payload...), payload...), reply.Data)
+}
+
+func TestCompressionConfig(t *testing.T) {
+	cfg := Config{Address: []string{"nats://127.0.0.1:4222"}, Compression: CompressionConfig{Encoding: "brotli"}}
+	cfg.SetDefaults()
+	assert.True(t, errors.Is(cfg.Validate(), errors.ErrInvalidInput))
+
+	cfg.Compression.Encoding = EncodingZstd
+	assert.NoError(t, cfg.Validate())
+	assert.Equal(t, DefaultCompressionThreshold, cfg.Compression.Threshold)
+	assert.Equal(t, DefaultMaxDecompressedSize, cfg.Compression.MaxDecompressedSize)
+}
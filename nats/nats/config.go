@@ -0,0 +1,326 @@
+package nats
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/siangyeh8818/commonTools/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ConnectModeFailFast 連線失敗時 NewClient 直接回傳錯誤
+	ConnectModeFailFast = "fail_fast"
+	// ConnectModeRetry 每隔 ReconnectWait 重試, 直到連上或 ctx 結束
+	ConnectModeRetry = "retry"
+	// ConnectModeLazy 以斷線狀態啟動並在背景重連, 連上後才會送出先前的 Sub.
+	// 第一次連上前 Pub 會暫存在 Client (最多 ReconnectBufSize bytes), 連上後依序送出;
+	// Request 與 JSPub 需要回覆, 這段期間會回傳錯誤. 之後斷線期間的 Pub 會先放在 reconnect buffer
+	ConnectModeLazy = "lazy"
+)
+
+// Config 的預設值, 與 nats.go 的預設相同
+const (
+	DefaultConnectMode       = ConnectModeFailFast
+	DefaultContentType       = ContentTypeJSON
+	DefaultTimeout           = nats.DefaultTimeout              // 2s
+	DefaultPingInterval      = nats.DefaultPingInterval         // 2m
+	DefaultMaxReconnects     = nats.DefaultMaxReconnect         // 60
+	DefaultReconnectWait     = nats.DefaultReconnectWait        // 2s
+	DefaultReconnectBufSize  = nats.DefaultReconnectBufSize     // 8MB
+	DefaultDrainTimeout      = nats.DefaultDrainTimeout         // 30s
+	DefaultPendingMsgsLimit  = nats.DefaultSubPendingMsgsLimit  // 512k msgs
+	DefaultPendingBytesLimit = nats.DefaultSubPendingBytesLimit // 64MB
+	DefaultHandlerTimeout    = 30 * time.Second
+	DefaultShutdownGrace     = 10 * time.Second
+	DefaultHealthTimeout     = time.Second
+)
+
+const maskedSecret = "******"
+
+// Config for nats client
+type Config struct {
+	Name        string   `mapstructure:"name" yaml:"name"`
+	Address     []string `mapstructure:"address" yaml:"address"`
+	ClientID    string   `mapstructure:"client_id" yaml:"client_id"`       // 未設定時由 SetDefaults 產生 AppID_uuid
+	DurableName string   `mapstructure:"durable_name" yaml:"durable_name"` // 如果有設定, JetStream channel 會使用 durableName 加上 channel 名稱作為 durable consumer, 紀錄上一次讀到哪裡
+	AppID       string   `mapstructure:"app_id" yaml:"app_id"`
+	Account     string   `mapstructure:"account" yaml:"account"`
+	Password    string   `mapstructure:"password" yaml:"password"`         // 可用 env:NAME 或 file:/path 讀取
+	ContentType string   `mapstructure:"content_type" yaml:"content_type"` // PubTyped 使用的 codec, 預設 application/json
+
+	// 以下認證方式與 Account/Password 只能擇一
+	Token        string    `mapstructure:"token" yaml:"token"` // 可用 env:NAME 或 file:/path 讀取
+	NKeySeedFile string    `mapstructure:"nkey_seed_file" yaml:"nkey_seed_file"`
+	CredsFile    string    `mapstructure:"creds_file" yaml:"creds_file"` // decentralized JWT 帳號的 .creds
+	TLS          TLSConfig `mapstructure:"tls" yaml:"tls"`
+
+	ConnectMode   string        `mapstructure:"connect_mode" yaml:"connect_mode"`     // 啟動時連線失敗的處理方式, 預設 ConnectModeFailFast
+	MaxReconnects int           `mapstructure:"max_reconnects" yaml:"max_reconnects"` // 0 使用預設 60 次, -1 無限重連
+	ReconnectWait time.Duration `mapstructure:"reconnect_wait" yaml:"reconnect_wait"` // 也是 ConnectModeRetry 的重試間隔
+
+	Timeout           time.Duration `mapstructure:"timeout" yaml:"timeout"` // 建立連線的 timeout
+	PingInterval      time.Duration `mapstructure:"ping_interval" yaml:"ping_interval"`
+	ReconnectBufSize  int           `mapstructure:"reconnect_buf_size" yaml:"reconnect_buf_size"` // 斷線期間 Pub 暫存的 bytes, -1 不暫存
+	DrainTimeout      time.Duration `mapstructure:"drain_timeout" yaml:"drain_timeout"`
+	PendingMsgsLimit  int           `mapstructure:"pending_msgs_limit" yaml:"pending_msgs_limit"` // 每個訂閱未處理訊息的上限, -1 不限制
+	PendingBytesLimit int           `mapstructure:"pending_bytes_limit" yaml:"pending_bytes_limit"`
+	HandlerTimeout    time.Duration `mapstructure:"handler_timeout" yaml:"handler_timeout"` // 每則訊息 Handler 的預設執行時間
+	ShutdownGrace     time.Duration `mapstructure:"shutdown_grace" yaml:"shutdown_grace"`   // Shutdown 等待處理中的 Handler 多久後取消它們的 context
+	FlushTimeout      time.Duration `mapstructure:"flush_timeout" yaml:"flush_timeout"`     // 大於 0 時 Pub 會等 server 收到訊息, 最多等 FlushTimeout
+	HealthTimeout     time.Duration `mapstructure:"health_timeout" yaml:"health_timeout"`   // Health 量測 RTT 最多等多久, 逾時視為未就緒
+
+	JetStream   JetStreamConfig   `mapstructure:"jetstream" yaml:"jetstream"`
+	Compression CompressionConfig `mapstructure:"compression" yaml:"compression"`
+
+	// Events 連線事件的 callback, 只能在程式中設定
+	Events ConnEvents `mapstructure:"-" yaml:"-"`
+}
+
+// SetDefaults fills the zero fields with the Default values and generates ClientID
+func (c *Config) SetDefaults() {
+	if c.ConnectMode == "" {
+		c.ConnectMode = DefaultConnectMode
+	}
+	if c.ContentType == "" {
+		c.ContentType = DefaultContentType
+	}
+	if c.Timeout == 0 {
+		c.Timeout = DefaultTimeout
+	}
+	if c.PingInterval == 0 {
+		c.PingInterval = DefaultPingInterval
+	}
+	if c.MaxReconnects == 0 {
+		c.MaxReconnects = DefaultMaxReconnects
+	}
+	if c.ReconnectWait == 0 {
+		c.ReconnectWait = DefaultReconnectWait
+	}
+	if c.ReconnectBufSize == 0 {
+		c.ReconnectBufSize = DefaultReconnectBufSize
+	}
+	if c.DrainTimeout == 0 {
+		c.DrainTimeout = DefaultDrainTimeout
+	}
+	if c.PendingMsgsLimit == 0 {
+		c.PendingMsgsLimit = DefaultPendingMsgsLimit
+	}
+	if c.PendingBytesLimit == 0 {
+		c.PendingBytesLimit = DefaultPendingBytesLimit
+	}
+	if c.HandlerTimeout == 0 {
+		c.HandlerTimeout = DefaultHandlerTimeout
+	}
+	if c.ShutdownGrace == 0 {
+		c.ShutdownGrace = DefaultShutdownGrace
+	}
+	if c.HealthTimeout == 0 {
+		c.HealthTimeout = DefaultHealthTimeout
+	}
+	if c.Compression.Threshold == 0 {
+		c.Compression.Threshold = DefaultCompressionThreshold
+	}
+	if c.Compression.MaxDecompressedSize == 0 {
+		c.Compression.MaxDecompressedSize = DefaultMaxDecompressedSize
+	}
+	if c.ClientID == "" {
+		c.ClientID = uuid.New().String()
+		if c.AppID != "" {
+			c.ClientID = fmt.Sprintf("%s_%s", c.AppID, c.ClientID)
+		}
+	}
+}
+
+// Validate checks the config and tells what is misconfigured, it should be called after SetDefaults
+func (c *Config) Validate() error {
+	if len(c.Address) == 0 {
+		return errors.Wrapf(errors.ErrInvalidInput, "nats config: address is empty")
+	}
+	for _, addr := range c.Address {
+		if err := validateAddress(addr); err != nil {
+			return err
+		}
+	}
+
+	switch c.ConnectMode {
+	case ConnectModeFailFast, ConnectModeRetry, ConnectModeLazy:
+	default:
+		return errors.Wrapf(errors.ErrInvalidInput, "nats config: connect_mode %q should be one of %s, %s, %s", c.ConnectMode, ConnectModeFailFast, ConnectModeRetry, ConnectModeLazy)
+	}
+	if _, ok := GetCodec(c.ContentType); !ok {
+		return errors.Wrapf(errors.ErrInvalidInput, "nats config: content_type %q has no registered codec", c.ContentType)
+	}
+
+	for name, d := range map[string]time.Duration{
+		"timeout":         c.Timeout,
+		"ping_interval":   c.PingInterval,
+		"reconnect_wait":  c.ReconnectWait,
+		"drain_timeout":   c.DrainTimeout,
+		"handler_timeout": c.HandlerTimeout,
+		"shutdown_grace":  c.ShutdownGrace,
+		"flush_timeout":   c.FlushTimeout,
+		"health_timeout":  c.HealthTimeout,
+	} {
+		if d < 0 {
+			return errors.Wrapf(errors.ErrInvalidInput, "nats config: %s %s should not be negative", name, d)
+		}
+	}
+	if c.MaxReconnects < -1 {
+		return errors.Wrapf(errors.ErrInvalidInput, "nats config: max_reconnects %d should be -1 or positive", c.MaxReconnects)
+	}
+	if c.PendingMsgsLimit < -1 || c.PendingBytesLimit < -1 {
+		return errors.Wrapf(errors.ErrInvalidInput, "nats config: pending limits should be -1 or positive")
+	}
+	if c.PendingMsgsLimit == -1 && c.PendingBytesLimit == -1 {
+		return errors.Wrapf(errors.ErrInvalidInput, "nats config: pending_msgs_limit and pending_bytes_limit can not both be unlimited")
+	}
+
+	if c.Compression.Encoding != "" && !validEncoding(c.Compression.Encoding) {
+		return errors.Wrapf(errors.ErrInvalidInput, "nats config: compression encoding %q should be one of %s, %s, %s", c.Compression.Encoding, EncodingGzip, EncodingSnappy, EncodingZstd)
+	}
+	if c.Compression.Threshold < 0 || c.Compression.MaxDecompressedSize < 0 {
+		return errors.Wrapf(errors.ErrInvalidInput, "nats config: compression threshold and max_decompressed_size should not be negative")
+	}
+
+	for i, s := range c.JetStream.Streams {
+		if s.Name == "" {
+			return errors.Wrapf(errors.ErrInvalidInput, "nats config: jetstream stream #%d has no name", i)
+		}
+		if len(s.Subjects) == 0 {
+			return errors.Wrapf(errors.ErrInvalidInput, "nats config: jetstream stream %s has no subjects", s.Name)
+		}
+	}
+	for i, cc := range c.JetStream.Consumers {
+		if cc.Stream == "" {
+			return errors.Wrapf(errors.ErrInvalidInput, "nats config: jetstream consumer #%d has no stream", i)
+		}
+		if cc.DurableName == "" && c.DurableName == "" {
+			return errors.Wrapf(errors.ErrInvalidInput, "nats config: jetstream consumer #%d needs durable_name", i)
+		}
+	}
+
+	_, err := authOptions(c)
+	return err
+}
+
+func validateAddress(addr string) error {
+	if !strings.Contains(addr, "://") {
+		addr = "nats://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil || u.Hostname() == "" {
+		return errors.Wrapf(errors.ErrInvalidInput, "nats config: address %q is not a valid url", addr)
+	}
+	return nil
+}
+
+// String prints the config with password and token masked
+func (c Config) String() string {
+	type config Config
+	masked := config(c)
+	if masked.Password != "" {
+		masked.Password = maskedSecret
+	}
+	if masked.Token != "" {
+		masked.Token = maskedSecret
+	}
+	return fmt.Sprintf("%+v", masked)
+}
+
+// LoadConfigFromYAML reads the config from a yaml file using the yaml tags
+func LoadConfigFromYAML(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(errors.ErrInvalidInput, "nats config: fail to read %s, err: %s", path, err.Error())
+	}
+	cfg := &Config{}
+	if err := yaml.Unmarshal(b, cfg); err != nil {
+		return nil, errors.Wrapf(errors.ErrInvalidInput, "nats config: fail to parse %s, err: %s", path, err.Error())
+	}
+	return cfg, nil
+}
+
+// LoadConfigFromEnv overrides cfg with environment variables named prefix + the upper case mapstructure tag,
+// e.g. NATS_ADDRESS and NATS_JETSTREAM_ENABLED for prefix "NATS". Slices are comma separated,
+// slices of structs are only loaded from yaml. A nil cfg starts from an empty Config.
+func LoadConfigFromEnv(prefix string, cfg *Config) (*Config, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	if err := loadEnv(prefix, reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func loadEnv(prefix string, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("mapstructure")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := strings.ToUpper(prefix + "_" + tag)
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Struct {
+			if err := loadEnv(name, field); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			return errors.Wrapf(errors.ErrInvalidInput, "nats config: environment variable %s=%q is invalid, err: %s", name, value, err.Error())
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case field.Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	}
+	return nil
+}
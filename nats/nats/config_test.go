@@ -0,0 +1,108 @@
+package nats
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+func TestConfigSetDefaults(t *testing.T) {
+	cfg := Config{AppID: "order", Address: []string{"127.0.0.1:4222"}, PendingMsgsLimit: -1}
+	cfg.SetDefaults()
+
+	assert.Equal(t, ConnectModeFailFast, cfg.ConnectMode)
+	assert.Equal(t, ContentTypeJSON, cfg.ContentType)
+	assert.Equal(t, 2*time.Second, cfg.Timeout)
+	assert.Equal(t, 2*time.Minute, cfg.PingInterval)
+	assert.Equal(t, 60, cfg.MaxReconnects)
+	assert.Equal(t, 8*1024*1024, cfg.ReconnectBufSize)
+	assert.Equal(t, -1, cfg.PendingMsgsLimit)
+	assert.Equal(t, DefaultPendingBytesLimit, cfg.PendingBytesLimit)
+	assert.True(t, strings.HasPrefix(cfg.ClientID, "order_"))
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		Description string
+		Modify      func(c *Config)
+		Contains    string
+	}{
+		{"empty address", func(c *Config) { c.Address = nil }, "address is empty"},
+		{"invalid address", func(c *Config) { c.Address = []string{"nats://:4222"} }, "not a valid url"},
+		{"unknown connect mode", func(c *Config) { c.ConnectMode = "sometimes" }, "connect_mode"},
+		{"unknown content type", func(c *Config) { c.ContentType = "text/xml" }, "content_type"},
+		{"negative timeout", func(c *Config) { c.Timeout = -time.Second }, "timeout"},
+		{"invalid max reconnects", func(c *Config) { c.MaxReconnects = -2 }, "max_reconnects"},
+		{"unlimited pending", func(c *Config) { c.PendingMsgsLimit, c.PendingBytesLimit = -1, -1 }, "both be unlimited"},
+		{"stream without subjects", func(c *Config) { c.JetStream.Streams = []StreamConfig{{Name: "ORDERS"}} }, "has no subjects"},
+		{"consumer without durable", func(c *Config) { c.JetStream.Consumers = []ConsumerConfig{{Stream: "ORDERS"}} }, "durable_name"},
+		{"two auth methods", func(c *Config) { c.Account, c.Token = "a", "t" }, "only one auth method"},
+	}
+	for _, test := range tests {
+		cfg := Config{Address: []string{"nats://127.0.0.1:4222"}}
+		cfg.SetDefaults()
+		test.Modify(&cfg)
+		err := cfg.Validate()
+		assert.True(t, errors.Is(err, errors.ErrInvalidInput), test.Description)
+		assert.Contains(t, err.Error(), test.Contains, test.Description)
+	}
+}
+
+func TestConfigString(t *testing.T) {
+	cfg := Config{Account: "order", Password: "p@ss", Token: "t0ken"}
+	for _, s := range []string{cfg.String(), fmt.Sprint(&cfg), fmt.Sprintf("%v", cfg)} {
+		assert.Contains(t, s, "order")
+		assert.Contains(t, s, maskedSecret)
+		assert.NotContains(t, s, "p@ss")
+		assert.NotContains(t, s, "t0ken")
+	}
+	assert.Equal(t, "p@ss", cfg.Password)
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nats.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`
+name: order
+address:
+  - nats://127.0.0.1:4222
+reconnect_wait: 5s
+jetstream:
+  enabled: true
+  streams:
+    - name: ORDERS
+      subjects: ["orders.>"]
+`), 0600))
+
+	cfg, err := LoadConfigFromYAML(path)
+	require.NoError(t, err)
+	assert.Equal(t, "order", cfg.Name)
+	assert.Equal(t, 5*time.Second, cfg.ReconnectWait)
+	assert.Equal(t, []string{"orders.>"}, cfg.JetStream.Streams[0].Subjects)
+
+	t.Setenv("NATS_ADDRESS", "nats://a:4222, nats://b:4222")
+	t.Setenv("NATS_MAX_RECONNECTS", "-1")
+	t.Setenv("NATS_TLS_INSECURE_SKIP_VERIFY", "true")
+	t.Setenv("NATS_JETSTREAM_DOMAIN", "hub")
+	cfg, err = LoadConfigFromEnv("NATS", cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "order", cfg.Name)
+	assert.Equal(t, []string{"nats://a:4222", "nats://b:4222"}, cfg.Address)
+	assert.Equal(t, -1, cfg.MaxReconnects)
+	assert.True(t, cfg.TLS.InsecureSkipVerify)
+	assert.Equal(t, "hub", cfg.JetStream.Domain)
+	assert.True(t, cfg.JetStream.Enabled)
+
+	t.Setenv("NATS_TIMEOUT", "soon")
+	_, err = LoadConfigFromEnv("NATS", nil)
+	assert.True(t, errors.Is(err, errors.ErrInvalidInput))
+	assert.Contains(t, err.Error(), "NATS_TIMEOUT")
+}
@@ -0,0 +1,229 @@
+package nats
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+// HeaderMsgID is the message id stamped by Pub, JetStream uses the same header to drop duplicated publishes
+const HeaderMsgID = nats.MsgIdHdr
+
+const defaultDedupeSize = 100000
+
+// minDedupeLease keeps a claim alive when the handler context is about to expire or already expired,
+// a zero lease would never expire in redis
+const minDedupeLease = time.Second
+
+// StampMsgID sets a random message id unless the caller already set one
+func StampMsgID() Interceptor {
+	return func(next Publisher) Publisher {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			if msg.Header.Get(HeaderMsgID) == "" {
+				msg.Header.Set(HeaderMsgID, uuid.New().String())
+			}
+			return next(ctx, msg)
+		}
+	}
+}
+
+// DedupeState is the state of a message id in a DedupeStore
+type DedupeState int
+
+const (
+	// DedupeNew the id was unknown and is now claimed as in progress
+	DedupeNew DedupeState = iota
+	// DedupeInProgress another delivery of the id is still being processed
+	DedupeInProgress
+	// DedupeDone the id was processed successfully
+	DedupeDone
+)
+
+// DedupeStore remembers the ids of the messages being processed and processed
+type DedupeStore interface {
+	// Begin claims id as in progress for lease unless it is already known, it returns the state before the claim
+	Begin(ctx context.Context, id string, lease time.Duration) (DedupeState, error)
+	// Done records id as processed for ttl
+	Done(ctx context.Context, id string, ttl time.Duration) error
+	// Forget removes id so the message can be processed again
+	Forget(ctx context.Context, id string) error
+}
+
+// Dedupe skips the messages whose HeaderMsgID was already processed within ttl.
+// A duplicate that arrives while the first delivery is still running returns a retryable error,
+// so JetStream redelivers it later instead of acking it. The id is recorded as processed only when the
+// handler succeeds, and forgotten when it fails so a retry or redelivery runs it again.
+// The in progress claim lasts until the handler context deadline, at least a second.
+// Messages without the header, or when the store fails, are always processed.
+func Dedupe(store DedupeStore, ttl time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			id := msg.Header.Get(HeaderMsgID)
+			if id == "" {
+				return next(ctx, msg)
+			}
+			lease := ttl
+			if deadline, ok := ctx.Deadline(); ok {
+				lease = time.Until(deadline)
+			}
+			if lease < minDedupeLease {
+				lease = minDedupeLease
+			}
+			state, err := store.Begin(ctx, id, lease)
+			if err != nil {
+				log.Ctx(ctx).Warn().Msgf("fail to check duplicated message %s, err: %s", id, err.Error())
+				return next(ctx, msg)
+			}
+			switch state {
+			case DedupeDone:
+				log.Ctx(ctx).Info().Msgf("skip duplicated message %s", id)
+				return nil
+			case DedupeInProgress:
+				return errors.Wrapf(errors.ErrInternal, "duplicated message %s is still being processed", id)
+			}
+
+			// the handler context may be over, the store calls use their own
+			if err := next(ctx, msg); err != nil {
+				if fErr := store.Forget(context.Background(), id); fErr != nil {
+					log.Ctx(ctx).Warn().Msgf("fail to forget message %s, err: %s", id, fErr.Error())
+				}
+				return err
+			}
+			if dErr := store.Done(context.Background(), id, ttl); dErr != nil {
+				log.Ctx(ctx).Warn().Msgf("fail to mark message %s as processed, err: %s", id, dErr.Error())
+			}
+			return nil
+		}
+	}
+}
+
+type memoryEntry struct {
+	id      string
+	done    bool
+	expires time.Time
+}
+
+// memoryDedupeStore is an LRU of message ids with a ttl per id
+type memoryDedupeStore struct {
+	size  int
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+// NewMemoryDedupeStore keeps at most size ids in memory (預設 100000), the least recently marked are evicted first
+func NewMemoryDedupeStore(size int) DedupeStore {
+	if size <= 0 {
+		size = defaultDedupeSize
+	}
+	return &memoryDedupeStore{size: size, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+// Begin implement DedupeStore
+func (s *memoryDedupeStore) Begin(ctx context.Context, id string, lease time.Duration) (DedupeState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[id]; ok {
+		entry := e.Value.(*memoryEntry)
+		if time.Now().Before(entry.expires) {
+			if entry.done {
+				return DedupeDone, nil
+			}
+			return DedupeInProgress, nil
+		}
+	}
+	s.set(id, false, lease)
+	return DedupeNew, nil
+}
+
+// Done implement DedupeStore
+func (s *memoryDedupeStore) Done(ctx context.Context, id string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(id, true, ttl)
+	return nil
+}
+
+// set records id as the most recently marked, s.mu must be held
+func (s *memoryDedupeStore) set(id string, done bool, ttl time.Duration) {
+	if e, ok := s.items[id]; ok {
+		s.ll.Remove(e)
+	}
+	s.items[id] = s.ll.PushFront(&memoryEntry{id: id, done: done, expires: time.Now().Add(ttl)})
+	for s.ll.Len() > s.size {
+		oldest := s.ll.Back()
+		s.ll.Remove(oldest)
+		delete(s.items, oldest.Value.(*memoryEntry).id)
+	}
+}
+
+// Forget implement DedupeStore
+func (s *memoryDedupeStore) Forget(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[id]; ok {
+		s.ll.Remove(e)
+		delete(s.items, id)
+	}
+	return nil
+}
+
+type redisDedupeStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+const (
+	redisDedupeInProgress = "in_progress"
+	redisDedupeDone       = "done"
+)
+
+// NewRedisDedupeStore keeps the ids in redis, keys are prefix + id
+func NewRedisDedupeStore(client redis.UniversalClient, prefix string) DedupeStore {
+	return &redisDedupeStore{client: client, prefix: prefix}
+}
+
+// Begin implement DedupeStore
+func (s *redisDedupeStore) Begin(ctx context.Context, id string, lease time.Duration) (DedupeState, error) {
+	ok, err := s.client.SetNX(ctx, s.prefix+id, redisDedupeInProgress, lease).Result()
+	if err != nil {
+		return DedupeNew, errors.Wrapf(errors.ErrInternal, "fail to mark message %s in redis, err: %s", id, err.Error())
+	}
+	if ok {
+		return DedupeNew, nil
+	}
+	state, err := s.client.Get(ctx, s.prefix+id).Result()
+	switch {
+	case err == redis.Nil:
+		// expired in between, let the redelivery claim it
+		return DedupeInProgress, nil
+	case err != nil:
+		return DedupeNew, errors.Wrapf(errors.ErrInternal, "fail to get message %s in redis, err: %s", id, err.Error())
+	case state == redisDedupeDone:
+		return DedupeDone, nil
+	}
+	return DedupeInProgress, nil
+}
+
+// Done implement DedupeStore
+func (s *redisDedupeStore) Done(ctx context.Context, id string, ttl time.Duration) error {
+	if err := s.client.Set(ctx, s.prefix+id, redisDedupeDone, ttl).Err(); err != nil {
+		return errors.Wrapf(errors.ErrInternal, "fail to mark message %s as processed in redis, err: %s", id, err.Error())
+	}
+	return nil
+}
+
+// Forget implement DedupeStore
+func (s *redisDedupeStore) Forget(ctx context.Context, id string) error {
+	if err := s.client.Del(ctx, s.prefix+id).Err(); err != nil {
+		return errors.Wrapf(errors.ErrInternal, "fail to forget message %s in redis, err: %s", id, err.Error())
+	}
+	return nil
+}
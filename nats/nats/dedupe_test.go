@@ -0,0 +1,176 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+func testDedupeStore(t *testing.T, store DedupeStore) {
+	ctx := context.Background()
+	id := uuid.New().String()
+
+	state, err := store.Begin(ctx, id, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, DedupeNew, state)
+	state, err = store.Begin(ctx, id, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, DedupeInProgress, state)
+
+	require.NoError(t, store.Done(ctx, id, time.Minute))
+	state, err = store.Begin(ctx, id, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, DedupeDone, state)
+
+	require.NoError(t, store.Forget(ctx, id))
+	state, err = store.Begin(ctx, id, 50*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, DedupeNew, state)
+
+	time.Sleep(100 * time.Millisecond)
+	state, err = store.Begin(ctx, id, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, DedupeNew, state, "expired claim is processed again")
+}
+
+func TestMemoryDedupeStore(t *testing.T) {
+	testDedupeStore(t, NewMemoryDedupeStore(0))
+
+	store := NewMemoryDedupeStore(2)
+	ctx := context.Background()
+	for _, id := range []string{"a", "b", "c"} {
+		_, _ = store.Begin(ctx, id, time.Minute)
+		_ = store.Done(ctx, id, time.Minute)
+	}
+	state, _ := store.Begin(ctx, "a", time.Minute)
+	assert.Equal(t, DedupeNew, state, "least recently marked id is evicted")
+	state, _ = store.Begin(ctx, "c", time.Minute)
+	assert.Equal(t, DedupeDone, state)
+}
+
+func TestDedupeConcurrentDuplicate(t *testing.T) {
+	var calls int32
+	started, release := make(chan struct{}), make(chan error)
+	handler := Dedupe(NewMemoryDedupeStore(0), time.Minute)(func(ctx context.Context, msg *nats.Msg) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+			return <-release
+		}
+		return nil
+	})
+	msg := func() *nats.Msg {
+		return &nats.Msg{Subject: "dedupe", Header: nats.Header{HeaderMsgID: {"1"}}}
+	}
+
+	first := make(chan error, 1)
+	go func() { first <- handler(context.Background(), msg()) }()
+	<-started
+
+	// the duplicate is not dropped while the first delivery runs
+	err := handler(context.Background(), msg())
+	assert.True(t, errors.IsRetryable(err), err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// the first delivery fails, so the redelivery runs
+	release <- fmt.Errorf("temporary")
+	assert.Error(t, <-first)
+	assert.NoError(t, handler(context.Background(), msg()))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// once processed, duplicates are skipped
+	assert.NoError(t, handler(context.Background(), msg()))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestRedisDedupeStore(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR is not set")
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	defer client.Close()
+	testDedupeStore(t, NewRedisDedupeStore(client, "test:dedupe:"))
+}
+
+func TestDedupe(t *testing.T) {
+	c := newTestClient(t)
+
+	var calls int32
+	handled := make(chan string, 10)
+	_, err := c.Sub("dedupe", func(ctx context.Context, msg *nats.Msg) error {
+		n := atomic.AddInt32(&calls, 1)
+		if string(msg.Data) == "flaky" && n == 3 {
+			return fmt.Errorf("temporary")
+		}
+		handled <- string(msg.Data)
+		return nil
+	}, WithMiddlewares(Dedupe(NewMemoryDedupeStore(0), time.Minute)))
+	require.NoError(t, err)
+
+	pub := func(id, data string) {
+		require.NoError(t, c.Pub(context.Background(), "dedupe", map[string][]string{HeaderMsgID: {id}}, []byte(data)))
+	}
+	pub("1", "first")
+	pub("1", "first")
+	pub("2", "second")
+	// the failed attempt is forgotten so the redelivery runs
+	pub("3", "flaky")
+	pub("3", "flaky")
+	pub("3", "flaky")
+	require.NoError(t, c.Pub(context.Background(), "dedupe", nil, []byte("stamped")))
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		select {
+		case data := <-handled:
+			got = append(got, data)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("handled %v", got)
+		}
+	}
+	assert.Equal(t, []string{"first", "second", "flaky", "stamped"}, got)
+	select {
+	case data := <-handled:
+		t.Fatalf("duplicated %s handled", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// leaseStore records the lease of Begin
+type leaseStore struct {
+	DedupeStore
+	lease time.Duration
+}
+
+func (s *leaseStore) Begin(ctx context.Context, id string, lease time.Duration) (DedupeState, error) {
+	s.lease = lease
+	return s.DedupeStore.Begin(ctx, id, lease)
+}
+
+func TestDedupeLeaseExpiredContext(t *testing.T) {
+	store := &leaseStore{DedupeStore: NewMemoryDedupeStore(0)}
+	handler := Dedupe(store, time.Minute)(func(ctx context.Context, msg *nats.Msg) error { return nil })
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	msg := &nats.Msg{Subject: "dedupe", Header: nats.Header{HeaderMsgID: {"1"}}}
+	require.NoError(t, handler(ctx, msg))
+	assert.Equal(t, minDedupeLease, store.lease)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	msg.Header.Set(HeaderMsgID, "2")
+	require.NoError(t, handler(ctx, msg))
+	assert.True(t, store.lease > time.Minute)
+}
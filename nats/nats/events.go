@@ -0,0 +1,88 @@
+package nats
+
+import (
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// ConnEvents 連線事件的 callback, 未設定的欄位使用 DefaultConnEvents 的 log.
+// 要關閉某個事件的 log 請設定一個空的 func. Callback 由 nats 的事件 goroutine 呼叫, 不應該長時間阻塞.
+type ConnEvents struct {
+	// Connect 第一次連上 server 時呼叫, ConnectModeLazy 會在背景連上時呼叫
+	Connect    func(conn *nats.Conn)
+	Reconnect  func(conn *nats.Conn)
+	Disconnect func(conn *nats.Conn, err error) // err 為 nil 表示主動斷線
+	Closed     func(conn *nats.Conn)
+	// LameDuck server 即將關閉, 連線會在之後移到其他 server
+	LameDuck          func(conn *nats.Conn)
+	DiscoveredServers func(conn *nats.Conn)
+	// AsyncError 例如 slow consumer, sub 可能是 nil
+	AsyncError func(conn *nats.Conn, sub *nats.Subscription, err error)
+}
+
+// DefaultConnEvents returns the callbacks that log every event with the global logger
+func DefaultConnEvents() ConnEvents {
+	return defaultConnEvents(&log.Logger)
+}
+
+func defaultConnEvents(logger *zerolog.Logger) ConnEvents {
+	return ConnEvents{
+		Connect: func(conn *nats.Conn) {
+			logger.Info().Msgf(" nats connect event triggered url=%s", redactURL(conn.ConnectedUrl()))
+		},
+		Reconnect: func(conn *nats.Conn) {
+			logger.Info().Msgf(" nats reconnect event triggered url=%s", redactURL(conn.ConnectedUrl()))
+		},
+		Disconnect: func(conn *nats.Conn, err error) {
+			if err != nil {
+				logger.Error().Msgf(" nats disconnectErr event triggered cErr=%v", err)
+				return
+			}
+			logger.Info().Msg(" nats disconnectErr event triggered")
+		},
+		Closed: func(conn *nats.Conn) {
+			logger.Info().Msg(" nats closed event triggered")
+		},
+		LameDuck: func(conn *nats.Conn) {
+			logger.Warn().Msgf(" nats lame duck event triggered url=%s", redactURL(conn.ConnectedUrl()))
+		},
+		DiscoveredServers: func(conn *nats.Conn) {
+			logger.Info().Msgf(" nats discovered servers event triggered servers=%v", conn.DiscoveredServers())
+		},
+		AsyncError: func(conn *nats.Conn, sub *nats.Subscription, err error) {
+			if sub == nil {
+				logger.Error().Msgf(" nats error event triggered err=%v", err)
+				return
+			}
+			logger.Error().Msgf(" nats error event triggered sub=%s err=%v", sub.Subject, err)
+		},
+	}
+}
+
+// withDefaults fills the nil callbacks with the DefaultConnEvents logging to logger
+func (e ConnEvents) withDefaults(logger *zerolog.Logger) ConnEvents {
+	d := defaultConnEvents(logger)
+	if e.Connect == nil {
+		e.Connect = d.Connect
+	}
+	if e.Reconnect == nil {
+		e.Reconnect = d.Reconnect
+	}
+	if e.Disconnect == nil {
+		e.Disconnect = d.Disconnect
+	}
+	if e.Closed == nil {
+		e.Closed = d.Closed
+	}
+	if e.LameDuck == nil {
+		e.LameDuck = d.LameDuck
+	}
+	if e.DiscoveredServers == nil {
+		e.DiscoveredServers = d.DiscoveredServers
+	}
+	if e.AsyncError == nil {
+		e.AsyncError = d.AsyncError
+	}
+	return e
+}
@@ -0,0 +1,85 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnEvents(t *testing.T) {
+	port := freePort(t)
+	s := runServerOnPort(t, port)
+
+	events := make(chan string, 10)
+	record := func(name string) func(conn *nats.Conn) {
+		return func(conn *nats.Conn) { events <- name }
+	}
+	c, err := NewClient(&Config{
+		Address:       []string{fmt.Sprintf("nats://127.0.0.1:%d", port)},
+		ReconnectWait: 10 * time.Millisecond,
+		Events: ConnEvents{
+			Connect:   record("connect"),
+			Reconnect: record("reconnect"),
+			Disconnect: func(conn *nats.Conn, err error) {
+				events <- "disconnect"
+			},
+			Closed: record("closed"),
+		},
+	})
+	require.NoError(t, err)
+
+	next := func() string {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			return "timeout"
+		}
+	}
+	assert.Equal(t, "connect", next())
+
+	s.Shutdown()
+	assert.Equal(t, "disconnect", next())
+	runServerOnPort(t, port)
+	assert.Equal(t, "reconnect", next())
+
+	require.NoError(t, c.Close(context.Background()))
+	assert.Equal(t, "disconnect", next())
+	assert.Equal(t, "closed", next())
+}
+
+func TestConnEventsLazyConnect(t *testing.T) {
+	port := freePort(t)
+	connects := make(chan struct{}, 2)
+	c, err := NewClient(&Config{
+		Address:       []string{fmt.Sprintf("nats://127.0.0.1:%d", port)},
+		ConnectMode:   ConnectModeLazy,
+		ReconnectWait: 10 * time.Millisecond,
+		MaxReconnects: -1,
+		Events: ConnEvents{
+			Connect:   func(conn *nats.Conn) { connects <- struct{}{} },
+			Reconnect: func(conn *nats.Conn) { t.Error("first connect reported as reconnect") },
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close(context.Background())
+
+	runServerOnPort(t, port)
+	select {
+	case <-connects:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connect event not triggered")
+	}
+}
+
+func TestDefaultConnEventsNilSubscription(t *testing.T) {
+	assert.NotPanics(t, func() {
+		DefaultConnEvents().AsyncError(nil, nil, nats.ErrSlowConsumer)
+		DefaultConnEvents().AsyncError(nil, &nats.Subscription{Subject: "a"}, nats.ErrSlowConsumer)
+	})
+}
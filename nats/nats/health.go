@@ -0,0 +1,122 @@
+package nats
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Health 是 Client 目前的連線與訂閱狀態
+type Health struct {
+	Status         string               `json:"status"` // connected, reconnecting, connecting, disconnected, draining_subs, draining_pubs or closed
+	ServerURL      string               `json:"server_url,omitempty"`
+	RTT            time.Duration        `json:"rtt"`                       // 連線中才有值
+	Reconnects     uint64               `json:"reconnects"`                // 建立連線後重連的次數
+	LastReconnect  time.Time            `json:"last_reconnect"`            // 沒有重連過時為 zero
+	SinceReconnect time.Duration        `json:"since_reconnect,omitempty"` // 沒有重連過時為 0
+	Subscriptions  []SubscriptionHealth `json:"subscriptions"`
+	Error          string               `json:"error,omitempty"`
+}
+
+// SubscriptionHealth is the state of one subscription, SlowConsumer is set while its pending
+// messages or bytes reach the pending limits and new messages are dropped
+type SubscriptionHealth struct {
+	Subject      string `json:"subject"`
+	Group        string `json:"group,omitempty"`
+	PendingMsgs  int    `json:"pending_msgs"`
+	PendingBytes int    `json:"pending_bytes"`
+	Delivered    int64  `json:"delivered"`
+	Dropped      int    `json:"dropped"`
+	SlowConsumer bool   `json:"slow_consumer"`
+}
+
+// Live reports whether the connection can still recover, it is false once closed
+func (h Health) Live() bool {
+	return h.Status != "closed"
+}
+
+// Ready reports whether the client is connected, the server answered the RTT ping
+// and no subscription is a slow consumer
+func (h Health) Ready() bool {
+	if h.Status != "connected" || h.Error != "" {
+		return false
+	}
+	for _, s := range h.Subscriptions {
+		if s.SlowConsumer {
+			return false
+		}
+	}
+	return true
+}
+
+// Health returns the connection and subscription state, RTT pings the server when connected
+// and waits at most Config.HealthTimeout for the pong
+func (c *Client) Health() Health {
+	h := Health{
+		Status:     strings.ToLower(c.natsConn.Status().String()),
+		ServerURL:  redactURL(c.natsConn.ConnectedUrl()),
+		Reconnects: c.natsConn.Stats().Reconnects,
+	}
+	if last, ok := c.lastReconnect.Load().(time.Time); ok {
+		h.LastReconnect = last
+		h.SinceReconnect = time.Since(last)
+	}
+	if c.natsConn.IsConnected() {
+		start := time.Now()
+		if err := c.natsConn.FlushTimeout(c.cfg.HealthTimeout); err != nil {
+			h.Error = err.Error()
+		} else {
+			h.RTT = time.Since(start)
+		}
+	}
+
+	for _, s := range c.Subscriptions() {
+		sh := SubscriptionHealth{Subject: s.Subject(), Group: s.Channel.GroupName}
+		sh.PendingMsgs, sh.PendingBytes, _ = s.sub.Pending()
+		sh.Delivered, _ = s.sub.Delivered()
+		sh.Dropped, _ = s.sub.Dropped()
+		if maxMsgs, maxBytes, err := s.sub.PendingLimits(); err == nil {
+			sh.SlowConsumer = (maxMsgs > 0 && sh.PendingMsgs >= maxMsgs) || (maxBytes > 0 && sh.PendingBytes >= maxBytes)
+		}
+		h.Subscriptions = append(h.Subscriptions, sh)
+	}
+	return h
+}
+
+// redactURL drops the user and password of the server url
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	u.User = nil
+	return u.String()
+}
+
+// LivenessHandler responds 200 with the Health json until the connection is closed, then 503
+func (c *Client) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := c.Health()
+		writeHealth(w, h, h.Live())
+	})
+}
+
+// ReadinessHandler responds 200 with the Health json while Health.Ready, otherwise 503
+func (c *Client) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := c.Health()
+		writeHealth(w, h, h.Ready())
+	})
+}
+
+func writeHealth(w http.ResponseWriter, h Health, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(h)
+}
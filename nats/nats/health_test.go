@@ -0,0 +1,137 @@
+package nats
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func probe(t *testing.T, h http.Handler) (int, Health) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	var health Health
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &health))
+	return rec.Code, health
+}
+
+func TestHealth(t *testing.T) {
+	port := freePort(t)
+	s := runServerOnPort(t, port)
+	c, err := NewClient(&Config{
+		Name:          "test",
+		Address:       []string{fmt.Sprintf("nats://127.0.0.1:%d", port)},
+		ReconnectWait: 10 * time.Millisecond,
+		MaxReconnects: -1,
+	})
+	require.NoError(t, err)
+	defer c.Close(context.Background())
+
+	release := make(chan struct{})
+	sub, err := c.Sub("health", func(ctx context.Context, msg *nats.Msg) error {
+		<-release
+		return nil
+	})
+	require.NoError(t, err)
+
+	h := c.Health()
+	assert.Equal(t, "connected", h.Status)
+	assert.Equal(t, fmt.Sprintf("nats://127.0.0.1:%d", port), h.ServerURL)
+	assert.True(t, h.RTT > 0)
+	assert.True(t, h.LastReconnect.IsZero())
+	require.Len(t, h.Subscriptions, 1)
+	assert.Equal(t, "health", h.Subscriptions[0].Subject)
+	assert.True(t, h.Ready())
+
+	code, _ := probe(t, c.ReadinessHandler())
+	assert.Equal(t, http.StatusOK, code)
+
+	// the first message blocks the handler, the next ones fill the pending limit
+	require.NoError(t, sub.SetPendingLimits(2, -1))
+	for i := 0; i < 4; i++ {
+		require.NoError(t, c.Pub(context.Background(), "health", nil, nil))
+	}
+	require.Eventually(t, func() bool {
+		code, health := probe(t, c.ReadinessHandler())
+		return code == http.StatusServiceUnavailable && health.Subscriptions[0].SlowConsumer
+	}, 2*time.Second, 10*time.Millisecond)
+	close(release)
+	require.Eventually(t, func() bool { return c.Health().Ready() }, 2*time.Second, 10*time.Millisecond)
+	assert.True(t, c.Health().Subscriptions[0].Dropped > 0)
+
+	s.Shutdown()
+	require.Eventually(t, func() bool { return c.Health().Status == "reconnecting" }, 2*time.Second, 10*time.Millisecond)
+	code, _ = probe(t, c.ReadinessHandler())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	code, _ = probe(t, c.LivenessHandler())
+	assert.Equal(t, http.StatusOK, code)
+
+	runServerOnPort(t, port)
+	require.Eventually(t, func() bool { return c.Health().Ready() }, 5*time.Second, 10*time.Millisecond)
+	h = c.Health()
+	assert.Equal(t, uint64(1), h.Reconnects)
+	assert.False(t, h.LastReconnect.IsZero())
+
+	require.NoError(t, c.Close(context.Background()))
+	code, health := probe(t, c.LivenessHandler())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "closed", health.Status)
+}
+
+// stalledServer answers the ping of the handshake and then never answers again
+func stalledServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "INFO {\"server_id\":\"stalled\",\"version\":\"2.6.5\",\"proto\":1,\"max_payload\":1048576}\r\n")
+		r := bufio.NewReader(conn)
+		answered := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "PING") && !answered {
+				answered = true
+				fmt.Fprintf(conn, "PONG\r\n")
+			}
+		}
+	}()
+	return "nats://" + l.Addr().String()
+}
+
+func TestHealthTimeout(t *testing.T) {
+	c, err := NewClient(&Config{
+		Name:          "test",
+		Address:       []string{stalledServer(t)},
+		HealthTimeout: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer c.Close(context.Background())
+
+	start := time.Now()
+	h := c.Health()
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, "connected", h.Status)
+	assert.NotEmpty(t, h.Error)
+	assert.False(t, h.Ready())
+
+	code, _ := probe(t, c.ReadinessHandler())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
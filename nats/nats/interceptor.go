@@ -0,0 +1,87 @@
+package nats
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	traceRequestID "github.com/siangyeh8818/commonTools/trace/requestID"
+	traceTime "github.com/siangyeh8818/commonTools/trace/time"
+)
+
+// Publisher 送出訊息, Pub, JSPub, Request 與 Responder 的回覆最後都經由 Publisher 送出
+type Publisher func(ctx context.Context, msg *nats.Msg) error
+
+// Interceptor wraps a Publisher, it can change msg before next or fail the publish by not calling next
+type Interceptor func(next Publisher) Publisher
+
+// DefaultInterceptors returns the interceptors every Client starts with: StampTrace, StampMsgID and InjectTraceContext.
+// Use SetInterceptors to reorder or replace them.
+func DefaultInterceptors() []Interceptor {
+	return []Interceptor{StampTrace(), StampMsgID(), InjectTraceContext()}
+}
+
+// StampTrace sets the request_id and time headers from ctx unless the caller already set them
+func StampTrace() Interceptor {
+	return func(next Publisher) Publisher {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			if msg.Header.Get("request_id") == "" {
+				msg.Header.Set("request_id", traceRequestID.FromContext(ctx))
+			}
+			if msg.Header.Get("time") == "" {
+				msg.Header.Set("time", strconv.FormatInt(traceTime.GetFromContext(ctx), 10))
+			}
+			return next(ctx, msg)
+		}
+	}
+}
+
+// ChainInterceptors composes interceptors into one Interceptor, the first one is the outermost
+func ChainInterceptors(interceptors ...Interceptor) Interceptor {
+	return func(next Publisher) Publisher {
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			next = interceptors[i](next)
+		}
+		return next
+	}
+}
+
+// UseInterceptors appends interceptors to the client interceptors
+func (c *Client) UseInterceptors(interceptors ...Interceptor) {
+	c.icMu.Lock()
+	defer c.icMu.Unlock()
+	c.interceptors = append(c.interceptors, interceptors...)
+}
+
+// SetInterceptors replaces the client interceptors, including the defaults
+func (c *Client) SetInterceptors(interceptors ...Interceptor) {
+	c.icMu.Lock()
+	defer c.icMu.Unlock()
+	c.interceptors = append([]Interceptor(nil), interceptors...)
+}
+
+// Interceptors returns a copy of the client interceptors
+func (c *Client) Interceptors() []Interceptor {
+	c.icMu.RLock()
+	defer c.icMu.RUnlock()
+	return append([]Interceptor(nil), c.interceptors...)
+}
+
+// publish runs msg through the client interceptors, compresses it (see CompressionConfig) and then send
+func (c *Client) publish(ctx context.Context, msg *nats.Msg, send Publisher) error {
+	start := time.Now()
+	// compression runs after the interceptors so the size check sees what is sent
+	err := ChainInterceptors(c.Interceptors()...)(func(ctx context.Context, msg *nats.Msg) error {
+		if err := c.compress(msg); err != nil {
+			return err
+		}
+		if err := c.checkPayload(msg); err != nil {
+			return err
+		}
+		return send(ctx, msg)
+	})(c.withTracing(ctx), msg)
+	c.Metrics().Published(metricSubject(msg.Subject), time.Since(start), err)
+	return err
+}
@@ -0,0 +1,79 @@
+package nats
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siangyeh8818/commonTools/errors"
+	traceRequestID "github.com/siangyeh8818/commonTools/trace/requestID"
+)
+
+func TestInterceptors(t *testing.T) {
+	c := newTestClient(t)
+
+	got := make(chan *nats.Msg, 1)
+	_, err := c.Sub("ic.pub", func(ctx context.Context, msg *nats.Msg) error {
+		got <- msg
+		return nil
+	})
+	require.NoError(t, err)
+
+	var order []string
+	c.UseInterceptors(func(next Publisher) Publisher {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			order = append(order, "auth:"+msg.Header.Get("request_id"))
+			msg.Header.Set("authorization", "token")
+			return next(ctx, msg)
+		}
+	}, func(next Publisher) Publisher {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			order = append(order, "schema")
+			if msg.Subject == "ic.forbidden" {
+				return errors.Wrapf(errors.ErrNotAllowed, "publish to %s is not allowed", msg.Subject)
+			}
+			return next(ctx, msg)
+		}
+	})
+
+	ctx := traceRequestID.ContextWithXRequestID(context.Background(), "req-1")
+	require.NoError(t, c.Pub(ctx, "ic.pub", nil, []byte("hi")))
+	select {
+	case msg := <-got:
+		assert.Equal(t, "token", msg.Header.Get("authorization"))
+		assert.Equal(t, "req-1", msg.Header.Get("request_id"))
+		assert.NotEmpty(t, msg.Header.Get("time"))
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not received")
+	}
+	assert.Equal(t, []string{"auth:req-1", "schema"}, order)
+
+	err = c.Pub(ctx, "ic.forbidden", nil, nil)
+	assert.True(t, errors.Is(err, errors.ErrNotAllowed))
+}
+
+func TestSetInterceptors(t *testing.T) {
+	c := newTestClient(t)
+
+	got := make(chan *nats.Msg, 1)
+	_, err := c.Sub("ic.replace", func(ctx context.Context, msg *nats.Msg) error {
+		got <- msg
+		return nil
+	})
+	require.NoError(t, err)
+
+	c.SetInterceptors()
+	assert.Empty(t, c.Interceptors())
+	require.NoError(t, c.Pub(context.Background(), "ic.replace", map[string][]string{"a": {"b"}}, nil))
+	select {
+	case msg := <-got:
+		assert.Equal(t, "b", msg.Header.Get("a"))
+		assert.Empty(t, msg.Header.Get("request_id"))
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not received")
+	}
+}
@@ -0,0 +1,479 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+const (
+	defaultPullBatch = 10
+	pullMaxWait      = 5 * time.Second
+	// defaultAckWait is the AckWait of the server when the consumer does not set one
+	defaultAckWait = 30 * time.Second
+)
+
+// JetStreamConfig for JetStream publishing and consumers
+type JetStreamConfig struct {
+	Enabled   bool             `mapstructure:"enabled" yaml:"enabled"`
+	Domain    string           `mapstructure:"domain" yaml:"domain"`
+	Streams   []StreamConfig   `mapstructure:"streams" yaml:"streams"`
+	Consumers []ConsumerConfig `mapstructure:"consumers" yaml:"consumers"`
+}
+
+// StreamConfig is provisioned when the client starts, an existing stream is updated
+type StreamConfig struct {
+	Name     string        `mapstructure:"name" yaml:"name"`
+	Subjects []string      `mapstructure:"subjects" yaml:"subjects"`
+	Storage  string        `mapstructure:"storage" yaml:"storage"` // file or memory, default file
+	Replicas int           `mapstructure:"replicas" yaml:"replicas"`
+	MaxAge   time.Duration `mapstructure:"max_age" yaml:"max_age"`
+	// Retention limits, workqueue or interest, default limits. A dead-letter stream
+	// uses workqueue so replayed messages are removed, see ReplayDeadLetters
+	Retention string `mapstructure:"retention" yaml:"retention"`
+}
+
+// ConsumerConfig is provisioned when the client starts, an existing consumer is left untouched
+type ConsumerConfig struct {
+	Stream        string        `mapstructure:"stream" yaml:"stream"`
+	DurableName   string        `mapstructure:"durable_name" yaml:"durable_name"`
+	FilterSubject string        `mapstructure:"filter_subject" yaml:"filter_subject"`
+	DeliverGroup  string        `mapstructure:"deliver_group" yaml:"deliver_group"` // push consumer queue group, empty for a pull consumer
+	AckWait       time.Duration `mapstructure:"ack_wait" yaml:"ack_wait"`
+	MaxDeliver    int           `mapstructure:"max_deliver" yaml:"max_deliver"`
+}
+
+// termError marks a handler error as not retryable
+type termError struct {
+	err error
+}
+
+// Error implement error interface
+func (e *termError) Error() string {
+	return e.err.Error()
+}
+
+// Cause returns the wrapped error for errors.Cause
+func (e *termError) Cause() error {
+	return e.err
+}
+
+// Term wraps a handler error so the JetStream message is terminated instead of redelivered
+func Term(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &termError{err: err}
+}
+
+func (c *Client) initJetStream() error {
+	var opts []nats.JSOpt
+	if c.cfg.JetStream.Domain != "" {
+		opts = append(opts, nats.Domain(c.cfg.JetStream.Domain))
+	}
+	js, err := c.natsConn.JetStream(opts...)
+	if err != nil {
+		return errors.Wrapf(errors.ErrInternal, "fail to get jetstream context, err: %s", err.Error())
+	}
+	c.js = js
+	return nil
+}
+
+// provisionJetStream creates the streams and consumers of the config, the connection must be up
+func (c *Client) provisionJetStream() error {
+	for _, s := range c.cfg.JetStream.Streams {
+		if err := c.provisionStream(s); err != nil {
+			return err
+		}
+	}
+	for _, cc := range c.cfg.JetStream.Consumers {
+		if err := c.provisionConsumer(cc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) provisionStream(s StreamConfig) error {
+	sc := &nats.StreamConfig{
+		Name:     s.Name,
+		Subjects: s.Subjects,
+		Storage:  nats.FileStorage,
+		Replicas: s.Replicas,
+		MaxAge:   s.MaxAge,
+	}
+	if strings.EqualFold(s.Storage, "memory") {
+		sc.Storage = nats.MemoryStorage
+	}
+	switch strings.ToLower(s.Retention) {
+	case "workqueue":
+		sc.Retention = nats.WorkQueuePolicy
+	case "interest":
+		sc.Retention = nats.InterestPolicy
+	}
+
+	_, err := c.js.StreamInfo(s.Name)
+	switch {
+	case err == nats.ErrStreamNotFound:
+		_, err = c.js.AddStream(sc)
+	case err == nil:
+		_, err = c.js.UpdateStream(sc)
+	}
+	if err != nil {
+		return errors.Wrapf(errors.ErrInternal, "fail to provision stream %s, err: %s", s.Name, err.Error())
+	}
+	c.logger().Info().Msgf("Provision stream: %s", s.Name)
+	return nil
+}
+
+func (c *Client) provisionConsumer(cc ConsumerConfig) error {
+	durable := cc.DurableName
+	if durable == "" {
+		durable = c.durableName(Channel{ChannelName: cc.FilterSubject})
+	}
+	_, err := c.js.ConsumerInfo(cc.Stream, durable)
+	if err == nil {
+		return nil
+	}
+	if err != nats.ErrConsumerNotFound {
+		return errors.Wrapf(errors.ErrInternal, "fail to get consumer %s, err: %s", durable, err.Error())
+	}
+
+	conf := &nats.ConsumerConfig{
+		Durable:       durable,
+		FilterSubject: cc.FilterSubject,
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       cc.AckWait,
+		MaxDeliver:    cc.MaxDeliver,
+	}
+	if cc.DeliverGroup != "" {
+		conf.DeliverGroup = cc.DeliverGroup
+		conf.DeliverSubject = nats.NewInbox()
+	}
+	if _, err := c.js.AddConsumer(cc.Stream, conf); err != nil {
+		return errors.Wrapf(errors.ErrInternal, "fail to provision consumer %s, err: %s", durable, err.Error())
+	}
+	c.logger().Info().Msgf("Provision consumer: %s", durable)
+	return nil
+}
+
+// JSPub 推送至 JetStream, 等待 server 回覆 PubAck
+func (c *Client) JSPub(ctx context.Context, subject string, header map[string][]string, data []byte) (*nats.PubAck, error) {
+	if c.js == nil {
+		return nil, errors.Wrapf(errors.ErrInternal, "jetstream is not enabled")
+	}
+	var ack *nats.PubAck
+	err := c.publish(ctx, newMsg(subject, header, data), func(ctx context.Context, msg *nats.Msg) (err error) {
+		if err := c.checkConnected(); err != nil {
+			return err
+		}
+		if ack, err = c.js.PublishMsg(msg, nats.Context(ctx)); err != nil {
+			return errors.Wrapf(errors.ErrInternal, "fail to publish to jetstream, err: %s", err.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ack, nil
+}
+
+// durableName returns the durable consumer name of channel
+func (c *Client) durableName(channel Channel) string {
+	if channel.DurableName != "" {
+		return channel.DurableName
+	}
+	if c.cfg.DurableName == "" {
+		return ""
+	}
+	return c.cfg.DurableName + "_" + strings.NewReplacer(".", "_", "*", "_", ">", "_").Replace(channel.ChannelName)
+}
+
+func (c *Client) registerJetStreamChannel(channel Channel) (*Subscription, error) {
+	if c.js == nil {
+		return nil, errors.Wrapf(errors.ErrInternal, "jetstream is not enabled")
+	}
+	name, handler := channel.ChannelName, c.wrap(channel.Handler, channel.Middlewares)
+	durable := c.durableName(channel)
+
+	if channel.Pull && durable == "" {
+		return nil, errors.Wrapf(errors.ErrInvalidInput, "pull channel %s needs a durable name", name)
+	}
+	consumer, info, err := c.ensureConsumer(channel, durable)
+	if err != nil {
+		return nil, err
+	}
+
+	track := &inProgress{c: c, name: name, msgs: map[*nats.Msg]struct{}{}}
+	track.interval = info.Config.AckWait / 3
+	if track.interval <= 0 {
+		track.interval = defaultAckWait / 3
+	}
+	dispatch, pool := c.dispatcher(channel, func(msg *nats.Msg) {
+		err := c.process(channel, handler, msg)
+		track.done(msg)
+		if ackErr := ack(msg, err); ackErr != nil {
+			c.logger().Error().Msgf("channel: %s, fail to ack, err: %s", name, ackErr.Error())
+		}
+	}, func(msg *nats.Msg) {
+		// the pool is stopped, let the server redeliver msg now instead of after AckWait
+		track.done(msg)
+		_ = msg.Nak()
+	})
+	subscribed := false
+	defer func() {
+		// the subscription failed, nothing will use the pool or the consumer it created
+		if !subscribed {
+			pool.stop()
+			c.deleteConsumer(consumer)
+		}
+	}()
+	opts := []nats.SubOpt{nats.Bind(consumer.stream, consumer.name), nats.ManualAck()}
+
+	if channel.Pull {
+		sub, err := c.js.PullSubscribe(name, consumer.name, opts...)
+		if err != nil {
+			return nil, err
+		}
+		batch := channel.PullBatch
+		if batch <= 0 {
+			batch = defaultPullBatch
+		}
+		c.fetchers.Add(1)
+		go c.fetchLoop(sub, batch, track, dispatch)
+		subscribed = true
+		return c.addSubscription(channel, sub, pool, consumer, false)
+	}
+
+	receive := func(msg *nats.Msg) {
+		track.add(msg)
+		dispatch(msg)
+	}
+	var sub *nats.Subscription
+	if channel.GroupName != "" {
+		sub, err = c.js.QueueSubscribe(name, channel.GroupName, receive, opts...)
+	} else {
+		sub, err = c.js.Subscribe(name, receive, opts...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s, err := c.addSubscription(channel, sub, pool, consumer, true)
+	subscribed = err == nil
+	return s, err
+}
+
+// jsConsumer is the consumer of a JetStream subscription
+type jsConsumer struct {
+	stream string
+	name   string
+	// created by the subscription, it is deleted with it
+	created bool
+}
+
+// ensureConsumer returns the consumer of channel, creating it when it does not exist.
+// The client creates the consumers instead of nats.go, which deletes the consumers it created as soon as
+// a drained subscription delivered its last message, before the worker pools acked them.
+func (c *Client) ensureConsumer(channel Channel, durable string) (*jsConsumer, *nats.ConsumerInfo, error) {
+	stream, err := c.streamBySubject(channel.ChannelName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if durable != "" {
+		info, err := c.js.ConsumerInfo(stream, durable)
+		if err == nil {
+			return &jsConsumer{stream: stream, name: durable}, info, nil
+		}
+		if err != nats.ErrConsumerNotFound {
+			return nil, nil, errors.Wrapf(errors.ErrInternal, "fail to get consumer %s, err: %s", durable, err.Error())
+		}
+	}
+
+	conf := &nats.ConsumerConfig{
+		Durable:       durable,
+		FilterSubject: channel.ChannelName,
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       channel.AckWait,
+	}
+	if !channel.Pull {
+		conf.DeliverSubject = nats.NewInbox()
+		conf.DeliverGroup = channel.GroupName
+	}
+	info, err := c.js.AddConsumer(stream, conf)
+	if err != nil {
+		return nil, nil, errors.Wrapf(errors.ErrInternal, "fail to create consumer of %s, err: %s", channel.ChannelName, err.Error())
+	}
+	return &jsConsumer{stream: stream, name: info.Name, created: true}, info, nil
+}
+
+// deleteConsumer deletes the consumer when the subscription created it
+func (c *Client) deleteConsumer(consumer *jsConsumer) {
+	if consumer == nil || !consumer.created {
+		return
+	}
+	if err := c.js.DeleteConsumer(consumer.stream, consumer.name); err != nil && err != nats.ErrConsumerNotFound && err != nats.ErrConnectionClosed {
+		c.logger().Error().Msgf("fail to delete consumer %s, err: %s", consumer.name, err.Error())
+	}
+}
+
+// streamBySubject returns the stream storing subject
+func (c *Client) streamBySubject(subject string) (string, error) {
+	streams, err := c.streamsBySubject(subject)
+	if err != nil {
+		return "", err
+	}
+	if len(streams) != 1 {
+		return "", errors.Wrapf(errors.ErrInvalidInput, "%d streams store %s, expect 1", len(streams), subject)
+	}
+	return streams[0], nil
+}
+
+// streamsBySubject returns the streams storing subject, none for a core nats subject
+func (c *Client) streamsBySubject(subject string) ([]string, error) {
+	prefix := "$JS.API."
+	if c.cfg.JetStream.Domain != "" {
+		prefix = "$JS." + c.cfg.JetStream.Domain + ".API."
+	}
+	req, _ := json.Marshal(map[string]string{"subject": subject})
+	reply, err := c.natsConn.Request(prefix+"STREAM.NAMES", req, c.flushTimeout())
+	if err != nil {
+		return nil, errors.Wrapf(errors.ErrInternal, "fail to look up the stream of %s, err: %s", subject, err.Error())
+	}
+	var resp struct {
+		Streams []string `json:"streams"`
+		Error   *struct {
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(reply.Data, &resp); err != nil {
+		return nil, errors.Wrapf(errors.ErrInternal, "fail to look up the stream of %s, err: %s", subject, err.Error())
+	}
+	if resp.Error != nil {
+		return nil, errors.Wrapf(errors.ErrInternal, "fail to look up the stream of %s, err: %s", subject, resp.Error.Description)
+	}
+	return resp.Streams, nil
+}
+
+// fetchLoop pulls messages until the subscription or the connection is closed.
+// A fetch waits at most one in progress interval, the fetched messages are not tracked before it returns.
+func (c *Client) fetchLoop(sub *nats.Subscription, batch int, track *inProgress, process func(msg *nats.Msg)) {
+	defer c.fetchers.Done()
+	wait := pullMaxWait
+	if track.interval < wait {
+		wait = track.interval
+	}
+	for {
+		msgs, err := sub.Fetch(batch, nats.MaxWait(wait))
+		if err != nil {
+			if !sub.IsValid() || c.natsConn.IsClosed() {
+				return
+			}
+			if err != nats.ErrTimeout {
+				c.logger().Error().Msgf("subject: %s, fail to fetch, err: %s", sub.Subject, err.Error())
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		track.add(msgs...)
+		for _, msg := range msgs {
+			process(msg)
+		}
+	}
+}
+
+// inProgress sends InProgress every interval (a third of AckWait) for the messages of a JetStream subscription
+// from their delivery until they are processed, so the server does not redeliver them while they wait in
+// a worker queue or a pull batch, run a slow handler or wait for a retry.
+type inProgress struct {
+	c        *Client
+	name     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	msgs    map[*nats.Msg]struct{}
+	running bool
+}
+
+func (p *inProgress) add(msgs ...*nats.Msg) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, msg := range msgs {
+		p.msgs[msg] = struct{}{}
+	}
+	if !p.running && len(p.msgs) > 0 {
+		p.running = true
+		go p.run()
+	}
+}
+
+func (p *inProgress) done(msg *nats.Msg) {
+	p.mu.Lock()
+	delete(p.msgs, msg)
+	p.mu.Unlock()
+}
+
+// run ticks until no message is left
+func (p *inProgress) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.mu.Lock()
+		if len(p.msgs) == 0 {
+			p.running = false
+			p.mu.Unlock()
+			return
+		}
+		msgs := make([]*nats.Msg, 0, len(p.msgs))
+		for msg := range p.msgs {
+			msgs = append(msgs, msg)
+		}
+		p.mu.Unlock()
+
+		for _, msg := range msgs {
+			if err := msg.InProgress(); err != nil {
+				// acked by the handler, or the connection is gone and the message will be redelivered anyway
+				p.done(msg)
+				if err != nats.ErrInvalidJSAck {
+					p.c.logger().Warn().Msgf("channel: %s, fail to send in progress, err: %s", p.name, err.Error())
+				}
+			}
+		}
+	}
+}
+
+// ack acknowledges msg by the handler's error: nil acks, Term or ErrInvalidInput terminates, others nak for redelivery
+func ack(msg *nats.Msg, err error) error {
+	var ackErr error
+	switch {
+	case err == nil:
+		ackErr = msg.Ack()
+	case isTerm(err):
+		ackErr = msg.Term()
+	default:
+		ackErr = msg.Nak()
+	}
+	// the handler acked the message itself
+	if ackErr == nats.ErrInvalidJSAck {
+		return nil
+	}
+	return ackErr
+}
+
+func isTerm(err error) bool {
+	for err != nil {
+		if _, ok := err.(*termError); ok {
+			return true
+		}
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = cause.Cause()
+	}
+	return errors.Is(err, errors.ErrInvalidInput)
+}
@@ -0,0 +1,230 @@
+package nats
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siangyeh8818/commonTools/errors"
+	traceRequestID "github.com/siangyeh8818/commonTools/trace/requestID"
+)
+
+func newJetStreamClient(t *testing.T) *Client {
+	s := runServer(t, true)
+	c, err := NewClient(&Config{
+		Name:        "test",
+		Address:     []string{s.ClientURL()},
+		DurableName: "test",
+		JetStream: JetStreamConfig{
+			Enabled: true,
+			Streams: []StreamConfig{
+				{Name: "ORDERS", Subjects: []string{"orders.>"}, Storage: "memory"},
+				{Name: "DLQ", Subjects: []string{"dlq.>"}, Storage: "memory", Retention: "workqueue"},
+			},
+			Consumers: []ConsumerConfig{
+				{Stream: "ORDERS", DurableName: "provisioned", FilterSubject: "orders.provisioned"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close(context.Background()) })
+	return c
+}
+
+func TestJetStreamProvision(t *testing.T) {
+	c := newJetStreamClient(t)
+
+	info, err := c.js.StreamInfo("ORDERS")
+	require.NoError(t, err)
+	assert.Equal(t, nats.MemoryStorage, info.Config.Storage)
+
+	ci, err := c.js.ConsumerInfo("ORDERS", "provisioned")
+	require.NoError(t, err)
+	assert.Equal(t, "orders.provisioned", ci.Config.FilterSubject)
+}
+
+func TestJetStreamPushNakRedelivers(t *testing.T) {
+	c := newJetStreamClient(t)
+
+	var calls int32
+	done := make(chan string, 1)
+	_, err := c.RegisterChannel([]Channel{{
+		ChannelName: "orders.created",
+		GroupName:   "workers",
+		JetStream:   true,
+		Handler: func(ctx context.Context, msg *nats.Msg) error {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				return errors.ErrInternal
+			}
+			done <- traceRequestID.FromContext(ctx)
+			return nil
+		},
+	}})
+	require.NoError(t, err)
+
+	ctx := traceRequestID.ContextWithXRequestID(context.Background(), "req-1")
+	ack, err := c.JSPub(ctx, "orders.created", nil, []byte("1"))
+	require.NoError(t, err)
+	assert.Equal(t, "ORDERS", ack.Stream)
+
+	select {
+	case requestID := <-done:
+		assert.Equal(t, "req-1", requestID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not redelivered")
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	ci, err := c.js.ConsumerInfo("ORDERS", "test_orders_created")
+	require.NoError(t, err)
+	assert.Equal(t, "workers", ci.Config.DeliverGroup)
+}
+
+func TestJetStreamPullTerm(t *testing.T) {
+	c := newJetStreamClient(t)
+
+	var calls int32
+	_, err := c.RegisterChannel([]Channel{{
+		ChannelName: "orders.invalid",
+		JetStream:   true,
+		Pull:        true,
+		Handler: func(ctx context.Context, msg *nats.Msg) error {
+			atomic.AddInt32(&calls, 1)
+			return errors.ErrInvalidInput
+		},
+	}})
+	require.NoError(t, err)
+
+	_, err = c.JSPub(context.Background(), "orders.invalid", nil, []byte("1"))
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		ci, err := c.js.ConsumerInfo("ORDERS", "test_orders_invalid")
+		return err == nil && ci.AckFloor.Stream == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestAck(t *testing.T) {
+	assert.True(t, isTerm(Term(errors.ErrInternal)))
+	assert.True(t, isTerm(errors.Wrap(errors.ErrInvalidInput, "bad payload")))
+	assert.False(t, isTerm(errors.ErrInternal))
+	assert.Nil(t, Term(nil))
+}
+
+func TestJetStreamInProgress(t *testing.T) {
+	c := newJetStreamClient(t)
+
+	var slow, retried int32
+	done := make(chan struct{}, 2)
+	_, err := c.RegisterChannel([]Channel{{
+		ChannelName: "orders.slow",
+		JetStream:   true,
+		AckWait:     200 * time.Millisecond,
+		Handler: func(ctx context.Context, msg *nats.Msg) error {
+			atomic.AddInt32(&slow, 1)
+			time.Sleep(700 * time.Millisecond)
+			done <- struct{}{}
+			return nil
+		},
+	}, {
+		ChannelName: "orders.backoff",
+		JetStream:   true,
+		Pull:        true,
+		AckWait:     200 * time.Millisecond,
+		Retry:       &RetryPolicy{MaxAttempts: 2, InitialBackoff: 700 * time.Millisecond},
+		Handler: func(ctx context.Context, msg *nats.Msg) error {
+			if atomic.AddInt32(&retried, 1) == 1 {
+				return errors.ErrInternal
+			}
+			done <- struct{}{}
+			return nil
+		},
+	}})
+	require.NoError(t, err)
+
+	for _, subject := range []string{"orders.slow", "orders.backoff"} {
+		_, err := c.JSPub(context.Background(), subject, nil, []byte("1"))
+		require.NoError(t, err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not handled")
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&slow))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&retried))
+
+	ci, err := c.js.ConsumerInfo("ORDERS", "test_orders_slow")
+	require.NoError(t, err)
+	assert.Equal(t, 200*time.Millisecond, ci.Config.AckWait)
+	assert.Equal(t, 0, ci.NumAckPending)
+	assert.Equal(t, 0, ci.NumRedelivered)
+}
+
+func TestJetStreamWorkersDrainAcks(t *testing.T) {
+	c := newJetStreamClient(t)
+
+	var acked int32
+	_, err := c.RegisterChannel([]Channel{{
+		ChannelName: "orders.drain",
+		JetStream:   true,
+		Workers:     2,
+		QueueSize:   10,
+		Handler: func(ctx context.Context, msg *nats.Msg) error {
+			time.Sleep(50 * time.Millisecond)
+			// the queued messages are still acked while the client drains
+			if err := msg.AckSync(nats.Context(ctx)); err != nil {
+				return err
+			}
+			atomic.AddInt32(&acked, 1)
+			return nil
+		},
+	}})
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err := c.JSPub(context.Background(), "orders.drain", nil, []byte("1"))
+		require.NoError(t, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, c.Drain(ctx))
+	assert.Equal(t, int32(10), atomic.LoadInt32(&acked))
+}
+
+func TestJetStreamRegisterFailureStopsPool(t *testing.T) {
+	c := newJetStreamClient(t)
+	handler := func(ctx context.Context, msg *nats.Msg) error { return nil }
+
+	// rejected before a pool is created
+	_, err := c.RegisterChannel([]Channel{{ChannelName: "nostream.x", JetStream: true, Workers: 2, Handler: handler}})
+	require.Error(t, err)
+	c.cfg.DurableName = ""
+	_, err = c.RegisterChannel([]Channel{{ChannelName: "orders.nodurable", JetStream: true, Pull: true, Workers: 2, Handler: handler}})
+	assert.True(t, errors.Is(err, errors.ErrInvalidInput))
+	c.cfg.DurableName = "test"
+	assert.Empty(t, c.pools)
+
+	// the durable push consumer is already bound to a subscription
+	_, err = c.RegisterChannel([]Channel{{ChannelName: "orders.bound", JetStream: true, Workers: 2, Handler: handler}})
+	require.NoError(t, err)
+	_, err = c.RegisterChannel([]Channel{{ChannelName: "orders.bound", JetStream: true, Workers: 2, Handler: handler}})
+	require.Error(t, err)
+	require.Len(t, c.pools, 2)
+	select {
+	case <-c.pools[1].done:
+	default:
+		t.Fatal("the pool of the failed subscription is still running")
+	}
+}
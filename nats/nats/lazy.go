@@ -0,0 +1,67 @@
+package nats
+
+import (
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+// lazyBuffer keeps the publishes of ConnectModeLazy until the first connect.
+// nats.go rejects messages with headers until it knows the server supports them,
+// and every message carries the interceptor headers.
+type lazyBuffer struct {
+	mu      sync.Mutex
+	waiting bool // set until the first connect
+	msgs    []*nats.Msg
+	size    int
+}
+
+// publishMsg publishes msg, or buffers it while a lazy client waits for its first connect
+func (c *Client) publishMsg(msg *nats.Msg) error {
+	b := &c.lazy
+	b.mu.Lock()
+	if b.waiting {
+		defer b.mu.Unlock()
+		size := len(msg.Subject) + len(msg.Data) + headerSize(msg.Header)
+		if limit := c.cfg.ReconnectBufSize; limit < 0 || b.size+size > limit {
+			return errors.Wrapf(errors.ErrInternal, "nats is not connected yet and the publish buffer of %d bytes is full", limit)
+		}
+		b.msgs = append(b.msgs, msg)
+		b.size += size
+		return nil
+	}
+	b.mu.Unlock()
+
+	if err := c.natsConn.PublishMsg(msg); err != nil {
+		return errors.Wrapf(errors.ErrInternal, "fail to publish to nats, err: %s", err.Error())
+	}
+	return nil
+}
+
+// checkConnected rejects the publishes that wait for a reply before the first connect of a lazy client
+func (c *Client) checkConnected() error {
+	c.lazy.mu.Lock()
+	defer c.lazy.mu.Unlock()
+	if c.lazy.waiting {
+		return errors.Wrapf(errors.ErrInternal, "nats is not connected yet")
+	}
+	return nil
+}
+
+// releaseLazy publishes the buffered messages in order once conn is connected, later calls do nothing
+func (c *Client) releaseLazy(conn *nats.Conn) {
+	b := &c.lazy
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.waiting {
+		return
+	}
+	b.waiting = false
+	for _, msg := range b.msgs {
+		if err := conn.PublishMsg(msg); err != nil {
+			c.logger().Error().Msgf("fail to publish buffered message to %s, err: %s", msg.Subject, err.Error())
+		}
+	}
+	b.msgs, b.size = nil, 0
+}
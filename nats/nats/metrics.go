@@ -0,0 +1,86 @@
+package nats
+
+import (
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Metrics 收集 Client 的指標, 每個方法都可能被同時呼叫.
+// subject 為 channel 訂閱的 subject, group 為 channel 的 GroupName.
+type Metrics interface {
+	// Published is called after every publish, err is nil when it succeeded
+	Published(subject string, d time.Duration, err error)
+	// Received is called when a message is handed to a channel
+	Received(subject, group string)
+	// Handled is called after the handler, including its retries, returned
+	Handled(subject, group string, d time.Duration, err error)
+	// InFlight is called with +1 when a handler starts and -1 when it returns
+	InFlight(subject, group string, delta int)
+	// Pending reports the messages and bytes waiting in the subscription buffer
+	Pending(subject, group string, msgs, bytes int)
+	Reconnected()
+	Disconnected()
+	// SlowConsumer is called when the server or the client dropped messages of subject
+	SlowConsumer(subject string)
+}
+
+// NopMetrics discards every metric, it is the default of Client
+type NopMetrics struct{}
+
+func (NopMetrics) Published(subject string, d time.Duration, err error)      {}
+func (NopMetrics) Received(subject, group string)                            {}
+func (NopMetrics) Handled(subject, group string, d time.Duration, err error) {}
+func (NopMetrics) InFlight(subject, group string, delta int)                 {}
+func (NopMetrics) Pending(subject, group string, msgs, bytes int)            {}
+func (NopMetrics) Reconnected()                                              {}
+func (NopMetrics) Disconnected()                                             {}
+func (NopMetrics) SlowConsumer(subject string)                               {}
+
+// metricsBox keeps the Metrics in an atomic.Value, which needs one concrete type
+type metricsBox struct {
+	Metrics
+}
+
+// SetMetrics replaces the metrics of the client, nil restores NopMetrics
+func (c *Client) SetMetrics(m Metrics) {
+	if m == nil {
+		m = NopMetrics{}
+	}
+	c.metrics.Store(metricsBox{m})
+}
+
+// Metrics returns the metrics of the client
+func (c *Client) Metrics() Metrics {
+	if box, ok := c.metrics.Load().(metricsBox); ok {
+		return box.Metrics
+	}
+	return NopMetrics{}
+}
+
+// metricSubject keeps the reply inboxes from turning into one label value per request
+func metricSubject(subject string) string {
+	if strings.HasPrefix(subject, nats.InboxPrefix) {
+		return strings.TrimSuffix(nats.InboxPrefix, ".")
+	}
+	return subject
+}
+
+// observe records the received, in-flight and pending metrics of msg and returns the func to call once handled
+func (c *Client) observe(channel Channel, msg *nats.Msg) func(err error) {
+	m := c.Metrics()
+	subject, group := channel.ChannelName, channel.GroupName
+	m.Received(subject, group)
+	if msg.Sub != nil {
+		if msgs, bytes, err := msg.Sub.Pending(); err == nil {
+			m.Pending(subject, group, msgs, bytes)
+		}
+	}
+	m.InFlight(subject, group, 1)
+	start := time.Now()
+	return func(err error) {
+		m.InFlight(subject, group, -1)
+		m.Handled(subject, group, time.Since(start), err)
+	}
+}
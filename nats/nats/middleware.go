@@ -0,0 +1,129 @@
+package nats
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+	"github.com/siangyeh8818/commonTools/errors"
+
+	traceRequestID "github.com/siangyeh8818/commonTools/trace/requestID"
+	traceTime "github.com/siangyeh8818/commonTools/trace/time"
+)
+
+// Handler 處理訂閱收到的訊息
+type Handler func(ctx context.Context, msg *nats.Msg) error
+
+// Middleware wraps a Handler, it can run code before and after next or skip next entirely
+type Middleware func(next Handler) Handler
+
+type endpointKey struct{}
+
+// EndpointFromContext returns the channel name the message of ctx was received on
+func EndpointFromContext(ctx context.Context) string {
+	endpoint, _ := ctx.Value(endpointKey{}).(string)
+	return endpoint
+}
+
+// DefaultMiddlewares returns the middlewares every Client starts with, in order:
+// Trace, ExtractTraceContext, Logger, LogError and Recover. Use SetMiddlewares to reorder or replace them.
+func DefaultMiddlewares() []Middleware {
+	return []Middleware{Trace(), ExtractTraceContext(), Logger(), LogError(), Recover()}
+}
+
+// Trace puts the request_id and time headers of the publisher into the context
+func Trace() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			var requestID string
+			var t int64
+			if len(msg.Header["request_id"]) > 0 {
+				requestID = msg.Header["request_id"][0]
+			}
+			if len(msg.Header["time"]) > 0 {
+				t, _ = strconv.ParseInt(msg.Header["time"][0], 10, 64)
+			}
+			ctx = traceTime.ContextWithTime(traceRequestID.ContextWithXRequestID(ctx, requestID), t)
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Logger logs the message and injects the client logger (see WithLogger) with the time, request_id, endpoint and
+// trace_id into the context, get it with log.Ctx(ctx). Place it after Trace and ExtractTraceContext.
+func Logger() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			requestID, t := traceRequestID.FromContext(ctx), traceTime.GetFromContext(ctx)
+			logCtx := clientLogger(ctx).With().Int64("time", t).Str("request_id", requestID).Str("endpoint", EndpointFromContext(ctx))
+			if sc, ok := SpanContextFromContext(ctx); ok {
+				logCtx = logCtx.Str("trace_id", sc.TraceID.String())
+			}
+			logger := logCtx.Logger()
+			logger.Info().Msgf("%+v", msg)
+			return next(logger.WithContext(ctx), msg)
+		}
+	}
+}
+
+// LogError logs the error returned by next with the logger of the context
+func LogError() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			err := next(ctx, msg)
+			if err != nil {
+				logHandlerError(*log.Ctx(ctx), EndpointFromContext(ctx), err)
+			}
+			return err
+		}
+	}
+}
+
+// Recover turns a panic of next into an ErrInternal error, see errors.FromPanic
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			return errors.Recover(func() error {
+				return next(ctx, msg)
+			})
+		}
+	}
+}
+
+// Chain composes mws into one Middleware, the first one is the outermost
+func Chain(mws ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		for i := len(mws) - 1; i >= 0; i-- {
+			next = mws[i](next)
+		}
+		return next
+	}
+}
+
+// Use appends mws to the client middlewares, they apply to the channels registered afterwards
+func (c *Client) Use(mws ...Middleware) {
+	c.mwMu.Lock()
+	defer c.mwMu.Unlock()
+	c.middlewares = append(c.middlewares, mws...)
+}
+
+// SetMiddlewares replaces the client middlewares, including the defaults.
+// Without Recover a panicking handler is only caught and logged by the subscription itself.
+func (c *Client) SetMiddlewares(mws ...Middleware) {
+	c.mwMu.Lock()
+	defer c.mwMu.Unlock()
+	c.middlewares = append([]Middleware(nil), mws...)
+}
+
+// Middlewares returns a copy of the client middlewares
+func (c *Client) Middlewares() []Middleware {
+	c.mwMu.Lock()
+	defer c.mwMu.Unlock()
+	return append([]Middleware(nil), c.middlewares...)
+}
+
+// wrap applies the client middlewares and then the channel middlewares to handler
+func (c *Client) wrap(handler Handler, mws []Middleware) Handler {
+	return Chain(append(c.Middlewares(), mws...)...)(handler)
+}
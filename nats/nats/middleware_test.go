@@ -0,0 +1,87 @@
+package nats
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siangyeh8818/commonTools/errors"
+	traceRequestID "github.com/siangyeh8818/commonTools/trace/requestID"
+)
+
+func record(mu *sync.Mutex, calls *[]string, name string) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			mu.Lock()
+			*calls = append(*calls, name)
+			mu.Unlock()
+			return next(ctx, msg)
+		}
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	c := newTestClient(t)
+
+	var mu sync.Mutex
+	var calls []string
+	c.Use(record(&mu, &calls, "client"))
+
+	done := make(chan string, 1)
+	_, err := c.Sub("mw.order", func(ctx context.Context, msg *nats.Msg) error {
+		done <- traceRequestID.FromContext(ctx)
+		return nil
+	}, WithMiddlewares(record(&mu, &calls, "channel1"), record(&mu, &calls, "channel2")))
+	require.NoError(t, err)
+
+	ctx := traceRequestID.ContextWithXRequestID(context.Background(), "req-1")
+	require.NoError(t, c.Pub(ctx, "mw.order", nil, nil))
+
+	select {
+	case requestID := <-done:
+		assert.Equal(t, "req-1", requestID)
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not handled")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"client", "channel1", "channel2"}, calls)
+}
+
+func TestSetMiddlewares(t *testing.T) {
+	c := newTestClient(t)
+
+	done := make(chan error, 1)
+	capture := func(next Handler) Handler {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			err := next(ctx, msg)
+			done <- err
+			return err
+		}
+	}
+	// without Trace the request id is not extracted, Recover still turns the panic into an error
+	c.SetMiddlewares(capture, Recover())
+	assert.Len(t, c.Middlewares(), 2)
+
+	_, err := c.Sub("mw.replace", func(ctx context.Context, msg *nats.Msg) error {
+		assert.Equal(t, "mw.replace", EndpointFromContext(ctx))
+		panic("boom")
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.Pub(context.Background(), "mw.replace", nil, nil))
+
+	select {
+	case err := <-done:
+		assert.True(t, errors.Is(err, errors.ErrInternal))
+		v, _, ok := errors.PanicValue(err)
+		assert.True(t, ok)
+		assert.Equal(t, "boom", v)
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not handled")
+	}
+}
@@ -2,24 +2,18 @@ package nats
 
 import (
 	"context"
-	"fmt"
-	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/siangyeh8818/commonTools/errors"
 
-	traceRequestID "github.com/siangyeh8818/commonTools/trace/requestID"
-	traceTime "github.com/siangyeh8818/commonTools/trace/time"
-)
-
-var (
-	waitGroup sync.WaitGroup
+	commonTime "github.com/siangyeh8818/commonTools/time"
 )
 
 type Topic struct {
@@ -30,204 +24,551 @@ type Topic struct {
 
 type Client struct {
 	natsConn *nats.Conn
+	js       nats.JetStreamContext
 	cfg      *Config
 
+	closed    chan struct{} // closed by the nats ClosedHandler
+	closeOnce sync.Once
+	done      chan struct{} // closed once the worker pools finished after the connection is closed
+
+	// baseCtx is the parent of every handler context, it is cancelled once the client is done
+	baseCtx    context.Context
+	baseCancel context.CancelFunc
+
+	pools     []*workerPool
+	poolsMu   sync.Mutex
+	fetchers  sync.WaitGroup // pull fetch loops, see drain
+	inflight  inflight       // handlers running, see Shutdown
+	drainOnce sync.Once
+
+	subs   []*Subscription // active subscriptions, see Subscriptions
+	subsMu sync.Mutex
+
+	metrics    atomic.Value // metricsBox, see SetMetrics
+	exporter   atomic.Value // exporterBox, see SetSpanExporter
+	propagator atomic.Value // propagatorBox, see SetPropagator
+
+	lastReconnect atomic.Value // time.Time, see Health
+	lazy          lazyBuffer   // publishes before the first connect of ConnectModeLazy
+
+	baseLogger *zerolog.Logger // see WithLogger, nil uses the global logger
+
+	// codecs and contentType are set by WithCodec, they do not change once the client is created
+	codecs      map[string]Codec
+	contentType string
+
+	// middlewares wrap every handler, DefaultMiddlewares until replaced
+	middlewares []Middleware
+	mwMu        sync.Mutex
+	// interceptors wrap every publish, DefaultInterceptors until replaced
+	interceptors []Interceptor
+	icMu         sync.RWMutex
+
+	// Channels 最後一次傳給 RegisterChannel 的 channels, 目前的訂閱請用 Subscriptions
 	Channels []Channel
 }
 
-// NewClient ...
-func NewClient(cfg *Config) (*Client, error) {
-	nc, err := NewNatsConn(cfg)
-	if err != nil {
-		return nil, err
-	}
+// NewClient 建立 Client, opts 在連線前依序套用
+func NewClient(cfg *Config, opts ...Option) (*Client, error) {
+	return NewClientContext(context.Background(), cfg, opts...)
+}
 
+// NewClientContext 依 Config.ConnectMode 建立連線, ConnectModeRetry 會重試到 ctx 結束
+func NewClientContext(ctx context.Context, cfg *Config, opts ...Option) (*Client, error) {
+	conf := *cfg
 	client := Client{
-		natsConn: nc,
-		cfg:      cfg,
+		cfg:    &conf,
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+
+		middlewares:  DefaultMiddlewares(),
+		interceptors: DefaultInterceptors(),
+	}
+	client.SetMetrics(nil)
+	for _, opt := range opts {
+		opt(&client)
+	}
+	if client.natsConn != nil && len(conf.Address) == 0 {
+		conf.Address = client.natsConn.Servers()
 	}
+	conf.SetDefaults()
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	cfg = &conf
+	client.baseCtx, client.baseCancel = context.WithCancel(context.Background())
+
+	var provisionOnce sync.Once
+	jsReady := make(chan struct{})
+	handlers := newConnHandlers(cfg, client.logger(), connHooks{
+		onReconnect: func() {
+			client.lastReconnect.Store(time.Now())
+			client.Metrics().Reconnected()
+		},
+		onConnect: func(conn *nats.Conn) {
+			client.releaseLazy(conn)
+			// lazy connections provision JetStream once the first connect succeeds
+			if !cfg.JetStream.Enabled {
+				return
+			}
+			provisionOnce.Do(func() {
+				go func() {
+					<-jsReady
+					if client.js == nil {
+						return
+					}
+					if err := client.provisionJetStream(); err != nil {
+						client.logger().Error().Msgf("fail to provision jetstream, err: %+v", err)
+					}
+				}()
+			})
+		},
+		onClosed: func() {
+			client.closeOnce.Do(func() { close(client.closed) })
+		},
+		onDisconnect: func() {
+			client.Metrics().Disconnected()
+		},
+		onError: func(sub *nats.Subscription, err error) {
+			if err == nats.ErrSlowConsumer && sub != nil {
+				client.Metrics().SlowConsumer(sub.Subject)
+			}
+		},
+	})
+	nc := client.natsConn
+	if nc != nil {
+		handlers.attach(nc)
+	} else {
+		client.lazy.waiting = cfg.ConnectMode == ConnectModeLazy
+		var err error
+		nc, err = newNatsConn(ctx, cfg, handlers)
+		if err != nil {
+			client.baseCancel()
+			return nil, err
+		}
+		client.natsConn = nc
+		if nc.IsConnected() {
+			client.releaseLazy(nc)
+		}
+	}
+	go client.finish()
 
-	//client.natsConn.SetReconnectHandler(client.reconnect)
+	if cfg.JetStream.Enabled {
+		err := client.initJetStream()
+		close(jsReady)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+		if nc.IsConnected() {
+			provisionOnce.Do(func() { err = client.provisionJetStream() })
+			if err != nil {
+				nc.Close()
+				return nil, err
+			}
+		}
+	}
 
 	return &client, nil
 }
 
 // NewNatsConn ...
 func NewNatsConn(c *Config) (*nats.Conn, error) {
+	conf := *c
+	conf.SetDefaults()
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return newNatsConn(context.Background(), &conf, newConnHandlers(&conf, &log.Logger, connHooks{}))
+}
 
-	waitGroup.Add(1)
+// connHooks are called by the nats connection handlers after the ConnEvents callbacks
+type connHooks struct {
+	onConnect    func(conn *nats.Conn) // the first connect of a lazy connection, and every reconnect
+	onReconnect  func()
+	onClosed     func()
+	onDisconnect func()
+	onError      func(sub *nats.Subscription, err error)
+}
 
-	var natsConn *nats.Conn
+// connHandlers are the nats connection handlers, they call the ConnEvents and then the connHooks
+type connHandlers struct {
+	events    ConnEvents
+	hooks     connHooks
+	logger    *zerolog.Logger
+	connected int32 // set by the first connect
+}
 
-	natsConn, err := nats.Connect(strings.Join(c.Address, ","),
-		nats.Name(c.Name),
-		//nats.MaxReconnects(-1),
-		//nats.ReconnectWait(5*time.Second),
-		nats.UserInfo(c.Account, c.Password),
-		nats.ReconnectHandler(func(conn *nats.Conn) {
-			log.Info().Msg(" nats reconnect event triggered")
-		}),
-		nats.DisconnectErrHandler(func(conn *nats.Conn, cErr error) {
-			if cErr != nil {
-				log.Error().Msgf(" nats disconnectErr event triggered cErr=%v", cErr)
-				return
-			}
-			log.Info().Msg(" nats disconnectErr event triggered")
-		}),
-		nats.ClosedHandler(func(conn *nats.Conn) {
-			log.Info().Msg(" nats closed event triggered")
-			waitGroup.Done()
-		}),
-		nats.ErrorHandler(func(conn *nats.Conn, sub *nats.Subscription, sErr error) {
-			log.Error().Msgf("XLB: nats error event triggered sub=%s sErr=%v", sub.Subject, sErr)
-		}),
-	)
+func newConnHandlers(c *Config, logger *zerolog.Logger, hooks connHooks) *connHandlers {
+	return &connHandlers{events: c.Events.withDefaults(logger), hooks: hooks, logger: logger}
+}
 
-	if err != nil {
-		log.Error().Msgf("connect to nats server error %s", err.Error())
+// connect fires the Connect event once the connection is established
+func (h *connHandlers) connect(conn *nats.Conn) {
+	if atomic.CompareAndSwapInt32(&h.connected, 0, 1) {
+		h.events.Connect(conn)
 	}
+}
 
-	if c.ClientID == "" {
-		c.ClientID = uuid.New().String()
-		if c.AppID != "" {
-			c.ClientID = fmt.Sprintf("%s_%s", c.AppID, c.ClientID)
+func (h *connHandlers) reconnect(conn *nats.Conn) {
+	// a lazy connection reports its first connect as a reconnect
+	if atomic.CompareAndSwapInt32(&h.connected, 0, 1) {
+		h.events.Connect(conn)
+	} else {
+		h.events.Reconnect(conn)
+		if h.hooks.onReconnect != nil {
+			h.hooks.onReconnect()
 		}
 	}
-	return natsConn, nil
+	if h.hooks.onConnect != nil {
+		h.hooks.onConnect(conn)
+	}
 }
 
-// 連線流放
+func (h *connHandlers) disconnect(conn *nats.Conn, err error) {
+	h.events.Disconnect(conn, err)
+	if h.hooks.onDisconnect != nil {
+		h.hooks.onDisconnect()
+	}
+}
 
-func (c *Client) Drain() error {
-	err := c.natsConn.Drain()
+func (h *connHandlers) close(conn *nats.Conn) {
+	h.events.Closed(conn)
+	if h.hooks.onClosed != nil {
+		h.hooks.onClosed()
+	}
+}
+
+func (h *connHandlers) asyncError(conn *nats.Conn, sub *nats.Subscription, err error) {
+	h.events.AsyncError(conn, sub, err)
+	if h.hooks.onError != nil {
+		h.hooks.onError(sub, err)
+	}
+}
+
+func (h *connHandlers) options() []nats.Option {
+	return []nats.Option{
+		nats.ReconnectHandler(h.reconnect),
+		nats.DisconnectErrHandler(h.disconnect),
+		nats.ClosedHandler(h.close),
+		nats.LameDuckModeHandler(func(conn *nats.Conn) { h.events.LameDuck(conn) }),
+		nats.DiscoveredServersHandler(func(conn *nats.Conn) { h.events.DiscoveredServers(conn) }),
+		nats.ErrorHandler(h.asyncError),
+	}
+}
+
+// attach replaces the handlers of a connection created elsewhere, nats has no setter for the lame duck handler.
+// A closed conn runs the closed handler right away.
+func (h *connHandlers) attach(conn *nats.Conn) {
+	conn.SetReconnectHandler(h.reconnect)
+	conn.SetDisconnectErrHandler(h.disconnect)
+	conn.SetClosedHandler(h.close)
+	conn.SetDiscoveredServersHandler(func(conn *nats.Conn) { h.events.DiscoveredServers(conn) })
+	conn.SetErrorHandler(h.asyncError)
+	if conn.IsConnected() {
+		atomic.StoreInt32(&h.connected, 1)
+	}
+	if conn.IsClosed() {
+		h.close(conn)
+	}
+}
+
+// newNatsConn connects to nats according to c.ConnectMode, c must have its defaults set
+func newNatsConn(ctx context.Context, c *Config, handlers *connHandlers) (*nats.Conn, error) {
+	authOpts, err := authOptions(c)
+	if err != nil {
+		return nil, err
+	}
+	opts := append(authOpts,
+		nats.Name(c.Name),
+		nats.Timeout(c.Timeout),
+		nats.PingInterval(c.PingInterval),
+		nats.MaxReconnects(c.MaxReconnects),
+		nats.ReconnectWait(c.ReconnectWait),
+		nats.ReconnectBufSize(c.ReconnectBufSize),
+		nats.DrainTimeout(c.DrainTimeout),
+	)
+	opts = append(opts, handlers.options()...)
+	if c.ConnectMode == ConnectModeLazy {
+		opts = append(opts, nats.RetryOnFailedConnect(true))
+	}
+
+	url := strings.Join(c.Address, ",")
+	natsConn, err := nats.Connect(url, opts...)
+	for err != nil && c.ConnectMode == ConnectModeRetry {
+		handlers.logger.Error().Msgf("connect to nats server error %s, retrying", err.Error())
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(errors.ErrInternal, "connect to nats server error %s, %s", err.Error(), ctx.Err().Error())
+		case <-time.After(c.ReconnectWait):
+		}
+		natsConn, err = nats.Connect(url, opts...)
+	}
 	if err != nil {
-		return err
+		handlers.logger.Error().Msgf("connect to nats server error %s", err.Error())
+		return nil, errors.Wrapf(errors.ErrInternal, "connect to nats server error %s", err.Error())
+	}
+	if natsConn.IsConnected() {
+		handlers.connect(natsConn)
 	}
-	waitGroup.Wait()
+	return natsConn, nil
+}
 
-	return nil
+// Drain 連線流放, 處理完已收到的訊息後關閉連線, 處理中的 Handler 仍可 Ack 與推送.
+// ctx 結束時直接關閉連線, 重複呼叫會等待同一次關閉
+func (c *Client) Drain(ctx context.Context) error {
+	c.drain()
+	return c.waitClosed(ctx)
 }
 
+// Close 直接關閉連線, 不等待處理中的訊息
+func (c *Client) Close(ctx context.Context) error {
+	c.natsConn.Close()
+	return c.waitClosed(ctx)
+}
 
-// Config for stan client
-type Config struct {
-	Name        string   `mapstructure:"name" yaml:"name"`
-	Address     []string `mapstructure:"address" yaml:"address"`
-	ClientID    string   `mapstructure:"client_id" yaml:"client_id"`
-	DurableName string   `mapstructure:"durable_name" yaml:"durable_name"` // 如果有設定所有channel 會使用同一個 durableName. 提供 stan 去紀錄, 上一次讀到哪裡
-	AppID       string   `mapstructure:"app_id" yaml:"app_id"`
-	Account     string   `mapstructure:"account" yaml:"account"`
-	Password    string   `mapstructure:"password" yaml:"password"`
+// finish stops the worker pools once the connection is closed and then cancels the handler contexts
+func (c *Client) finish() {
+	<-c.closed
+	c.stopPools()
+	c.baseCancel()
+	close(c.done)
 }
 
+func (c *Client) waitClosed(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		c.natsConn.Close()
+		c.baseCancel()
+		return errors.Wrapf(errors.ErrInternal, "fail to drain nats connection, err: %s", ctx.Err().Error())
+	}
+}
 
 
-// Pub 推送
+// Pub 推送, Config.FlushTimeout 大於 0 時會等待 server 收到訊息
 func (c *Client) Pub(ctx context.Context, subject string, header map[string][]string, data []byte) error {
+	return c.publish(ctx, newMsg(subject, header, data), func(ctx context.Context, msg *nats.Msg) error {
+		if err := c.publishMsg(msg); err != nil {
+			return err
+		}
+		if c.cfg.FlushTimeout > 0 {
+			if err := c.natsConn.FlushTimeout(c.cfg.FlushTimeout); err != nil {
+				return errors.Wrapf(errors.ErrInternal, "fail to flush nats connection, err: %s", err.Error())
+			}
+		}
+		return nil
+	})
+}
 
-	var h = nats.Header{
-		"request_id": []string{traceRequestID.FromContext(ctx)},
-		"time":       []string{strconv.FormatInt(traceTime.GetFromContext(ctx), 10)},
+// deadlineFromHeader reads the deadline header set by the publisher
+func deadlineFromHeader(h nats.Header) (time.Time, bool) {
+	v := h.Get(HeaderDeadline)
+	if v == "" {
+		return time.Time{}, false
 	}
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return commonTime.UnixMillis(ms), true
+}
+
+// newMsg builds the message to publish, the interceptors add the request id and time headers
+func newMsg(subject string, header map[string][]string, data []byte) *nats.Msg {
+	var h = nats.Header{}
 	for k, v := range header {
 		h[k] = v
 	}
-	msg := &nats.Msg{
+	return &nats.Msg{
 		Subject: subject,
 		Header:  h,
 		Data:    data,
 	}
-	if err := c.natsConn.PublishMsg(msg); err != nil {
-		return errors.Wrapf(errors.ErrInternal, "fail to publish to nats, err: %s", err.Error())
-	}
-
-	return nil
 }
 
 // Channel ...
 type Channel struct {
 	ChannelName string
 	GroupName   string
-	Handler     func(ctx context.Context, msg *nats.Msg) error
+	Handler     Handler
+	// Middlewares 在 Client 的 middlewares 之後套用到 Handler
+	Middlewares []Middleware
+
+	// JetStream 使用 JetStream durable consumer 訂閱, 依 Handler 回傳的 error 決定 Ack/Nak/Term
+	JetStream bool
+	// DurableName 未設定時使用 Config.DurableName 加上 ChannelName
+	DurableName string
+	// Pull 使用 pull consumer, 每次取 PullBatch 筆
+	Pull      bool
+	PullBatch int
+	// AckWait 為訊息處理中 server 等待 Ack 的時間, 未設定時沿用 consumer 的設定 (預設 30s).
+	// 訊息收到後到處理完 (包含 worker queue, pull batch 與重試間的等待) 每 1/3 個 AckWait 會送出 InProgress, 避免 server 重送
+	AckWait time.Duration
+
+	// Timeout 每則訊息 Handler 的執行時間, 未設定時使用 Config.HandlerTimeout
+	Timeout time.Duration
+
+	// Workers 大於 1 時以 Workers 個 goroutine 同時處理訊息, 最多暫存 QueueSize 筆 (預設 Workers),
+	// 暫存滿時訊息留在 nats 的 pending buffer, 超過 Config.PendingMsgsLimit 會被視為 slow consumer.
+	// OrderKey 為 header 名稱, 相同值的訊息會依序處理
+	Workers   int
+	QueueSize int
+	OrderKey  string
+
+	// Retry 未設定時 Handler 失敗只會記錄 log
+	Retry *RetryPolicy
 }
 
-//  Sub...
-func (c *Client) Sub(topic string, handler func(ctx context.Context, msg *nats.Msg) error) error {
-
-	_, err := c.natsConn.Subscribe(topic, func(msg *nats.Msg) {
-		defer recoverLog()
-		internalCtx, _ := context.WithTimeout(context.Background(), 30*time.Second)
-		var requestID string
-		var t int64
-		if len(msg.Header["request_id"]) > 0 {
-			requestID = msg.Header["request_id"][0]
-		}
-		if len(msg.Header["time"]) > 0 {
-			t, _ = strconv.ParseInt(msg.Header["time"][0], 10, 64)
-		}
-		internalCtx = traceTime.ContextWithTime(traceRequestID.ContextWithXRequestID(internalCtx, requestID), t)
-		logger := log.With().Int64("time", t).Str("request_id", requestID).Str("endpoint", topic).Logger()
-		logger.Info().Msgf("%+v", msg)
-		internalCtx = logger.WithContext(internalCtx)
+// SubOption configures the channel created by Sub
+type SubOption func(channel *Channel)
 
-		err := handler(internalCtx, msg)
-		if err != nil {
-			logger.Error().Msgf("channel: %s, error: %+v", topic, err)
-		}
-	})
-	if err != nil {
-		return err
+// WithHandlerTimeout sets the handler timeout of Sub, see Channel.Timeout
+func WithHandlerTimeout(timeout time.Duration) SubOption {
+	return func(channel *Channel) {
+		channel.Timeout = timeout
+	}
+}
+
+// WithWorkers processes the messages of Sub concurrently, see Channel.Workers
+func WithWorkers(workers, queueSize int) SubOption {
+	return func(channel *Channel) {
+		channel.Workers = workers
+		channel.QueueSize = queueSize
 	}
+}
 
-	return nil
+// WithMiddlewares applies mws to the handler of Sub after the client middlewares
+func WithMiddlewares(mws ...Middleware) SubOption {
+	return func(channel *Channel) {
+		channel.Middlewares = append(channel.Middlewares, mws...)
+	}
 }
 
-// RegisterChannel ...
-func (c *Client) RegisterChannel(channels []Channel) error {
+// WithOrderKey keeps the messages with the same header value in order, see Channel.OrderKey
+func WithOrderKey(header string) SubOption {
+	return func(channel *Channel) {
+		channel.OrderKey = header
+	}
+}
+
+//  Sub...
+func (c *Client) Sub(topic string, handler Handler, opts ...SubOption) (*Subscription, error) {
+	channel := Channel{ChannelName: topic, Handler: handler}
+	for _, opt := range opts {
+		opt(&channel)
+	}
+	return c.subscribe(channel, func(callback nats.MsgHandler) (*nats.Subscription, error) {
+		return c.natsConn.Subscribe(topic, callback)
+	})
+}
+
+// RegisterChannel 訂閱 channels, 失敗時回傳已建立的訂閱與 error
+func (c *Client) RegisterChannel(channels []Channel) ([]*Subscription, error) {
 	c.Channels = channels
+	subs := make([]*Subscription, 0, len(channels))
 	for i := range channels {
-		log.Info().Msgf("Register channel: %s", channels[i].ChannelName)
-		name, group, handler := channels[i].ChannelName, channels[i].GroupName, channels[i].Handler
-
-		_, err := c.natsConn.QueueSubscribe(name, group, func(msg *nats.Msg) {
-			defer recoverLog()
-			internalCtx, _ := context.WithTimeout(context.Background(), 30*time.Second)
-			var requestID string
-			var t int64
-			if len(msg.Header["request_id"]) > 0 {
-				requestID = msg.Header["request_id"][0]
-			}
-			if len(msg.Header["time"]) > 0 {
-				t, _ = strconv.ParseInt(msg.Header["time"][0], 10, 64)
-			}
-			internalCtx = traceTime.ContextWithTime(traceRequestID.ContextWithXRequestID(internalCtx, requestID), t)
-			logger := log.With().Int64("time", t).Str("request_id", requestID).Str("endpoint", name).Logger()
-			logger.Info().Msgf("%+v", msg)
-			internalCtx = logger.WithContext(internalCtx)
-
-			err := handler(internalCtx, msg)
+		c.logger().Info().Msgf("Register channel: %s", channels[i].ChannelName)
+		if channels[i].JetStream {
+			s, err := c.registerJetStreamChannel(channels[i])
 			if err != nil {
-				logger.Error().Msgf("channel: %s, error: %+v", name, err)
+				return subs, err
 			}
-
+			subs = append(subs, s)
+			continue
+		}
+		channel := channels[i]
+		s, err := c.subscribe(channel, func(callback nats.MsgHandler) (*nats.Subscription, error) {
+			return c.natsConn.QueueSubscribe(channel.ChannelName, channel.GroupName, callback)
 		})
 		if err != nil {
-			return err
+			return subs, err
 		}
+		subs = append(subs, s)
 	}
-	return nil
+	return subs, nil
 }
 
-func recoverLog() {
-	if r := recover(); r != nil {
-		var msg string
-		for i := 2; ; i++ {
-			_, file, line, ok := runtime.Caller(i)
-			if !ok {
-				break
-			}
-			msg += fmt.Sprintf("%s:%d\n", file, line)
+// subscribe runs the handler of the core nats channel on the subscription made by subscribe,
+// the worker pool of channel is stopped when subscribing fails
+func (c *Client) subscribe(channel Channel, subscribe func(callback nats.MsgHandler) (*nats.Subscription, error)) (*Subscription, error) {
+	handler := c.wrap(channel.Handler, channel.Middlewares)
+	callback, pool := c.dispatcher(channel, func(msg *nats.Msg) {
+		_ = c.process(channel, handler, msg)
+	}, nil)
+	subscribed := false
+	defer func() {
+		if !subscribed {
+			pool.stop()
 		}
-		log.Error().Msgf("%s\n↧↧↧↧↧↧ PANIC ↧↧↧↧↧↧\n%s↥↥↥↥↥↥ PANIC ↥↥↥↥↥↥", r, msg)
+	}()
+
+	sub, err := subscribe(callback)
+	if err != nil {
+		return nil, err
+	}
+	s, err := c.addSubscription(channel, sub, pool, nil, true)
+	subscribed = err == nil
+	return s, err
+}
+
+// setPendingLimits applies Config.PendingMsgsLimit and PendingBytesLimit to sub
+func (c *Client) setPendingLimits(sub *nats.Subscription) error {
+	return sub.SetPendingLimits(c.cfg.PendingMsgsLimit, c.cfg.PendingBytesLimit)
+}
+
+// handle runs handler for msg, handler is already wrapped with the middlewares of its channel.
+// The context times out after timeout, or Config.HandlerTimeout when it is zero, or earlier at the deadline header.
+func (c *Client) handle(endpoint string, timeout time.Duration, handler Handler, msg *nats.Msg) error {
+	defer c.recoverLog()
+	if timeout <= 0 {
+		timeout = c.cfg.HandlerTimeout
+	}
+	internalCtx, cancel := context.WithTimeout(c.baseCtx, timeout)
+	defer cancel()
+	if deadline, ok := deadlineFromHeader(msg.Header); ok {
+		var cancelDeadline context.CancelFunc
+		internalCtx, cancelDeadline = context.WithDeadline(internalCtx, deadline)
+		defer cancelDeadline()
+	}
+	internalCtx = context.WithValue(internalCtx, endpointKey{}, endpoint)
+	internalCtx = context.WithValue(internalCtx, codecKey{}, c.codec)
+	internalCtx = c.withTracing(context.WithValue(internalCtx, loggerKey{}, c.logger()))
+
+	return handler(internalCtx, msg)
+}
+
+func (c *Client) recoverLog() {
+	if r := recover(); r != nil {
+		logHandlerError(*c.logger(), "", errors.FromPanic(r))
+	}
+}
+
+// loggerKey holds the client logger in the handler context
+type loggerKey struct{}
+
+// logger returns the logger of WithLogger, or the global zerolog logger
+func (c *Client) logger() *zerolog.Logger {
+	if c.baseLogger != nil {
+		return c.baseLogger
+	}
+	return &log.Logger
+}
+
+// clientLogger returns the client logger of the handler context, or the global zerolog logger
+func clientLogger(ctx context.Context) *zerolog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*zerolog.Logger); ok {
+		return l
+	}
+	return &log.Logger
+}
+
+// logHandlerError logs the error returned by a handler, panics are logged with their stack
+func logHandlerError(logger zerolog.Logger, channel string, err error) {
+	if r, stack, ok := errors.PanicValue(err); ok {
+		logger.Error().Msgf("%v\n↧↧↧↧↧↧ PANIC ↧↧↧↧↧↧\n%s↥↥↥↥↥↥ PANIC ↥↥↥↥↥↥", r, stack)
+		return
 	}
+	logger.Error().Msgf("channel: %s, error: %+v", channel, err)
 }
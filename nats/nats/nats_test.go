@@ -0,0 +1,273 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+func runServer(t testing.TB, jetStream bool) *server.Server {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = jetStream
+	if jetStream {
+		opts.StoreDir = t.TempDir()
+	}
+	s := natsserver.RunServer(&opts)
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func newTestClient(t *testing.T) *Client {
+	s := runServer(t, false)
+	c, err := NewClient(&Config{Name: "test", Address: []string{s.ClientURL()}})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close(context.Background()) })
+	return c
+}
+
+func TestMultipleClientsDrain(t *testing.T) {
+	var clients []*Client
+	for i := 0; i < 3; i++ {
+		clients = append(clients, newTestClient(t), newTestClient(t))
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			got := make(chan struct{}, 1)
+			_, err := c.Sub("ping", func(ctx context.Context, msg *nats.Msg) error {
+				got <- struct{}{}
+				return nil
+			})
+			assert.NoError(t, err)
+			assert.NoError(t, c.Pub(context.Background(), "ping", nil, nil))
+			select {
+			case <-got:
+			case <-time.After(5 * time.Second):
+				t.Error("message was not handled")
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			assert.NoError(t, c.Drain(ctx))
+			assert.True(t, c.natsConn.IsClosed())
+		}(c)
+	}
+	wg.Wait()
+}
+
+func TestDrainIdempotent(t *testing.T) {
+	c := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	assert.NoError(t, c.Drain(ctx))
+	assert.NoError(t, c.Drain(ctx))
+	assert.NoError(t, c.Close(ctx))
+}
+
+func TestDrainTimeout(t *testing.T) {
+	c := newTestClient(t)
+	started := make(chan struct{})
+	_, err := c.Sub("slow", func(ctx context.Context, msg *nats.Msg) error {
+		close(started)
+		time.Sleep(time.Second)
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.Pub(context.Background(), "slow", nil, nil))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Error(t, c.Drain(ctx))
+	assert.True(t, c.natsConn.IsClosed())
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func runServerOnPort(t *testing.T, port int) *server.Server {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = port
+	s := natsserver.RunServer(&opts)
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func TestConnectFailFast(t *testing.T) {
+	_, err := NewClient(&Config{Address: []string{fmt.Sprintf("nats://127.0.0.1:%d", freePort(t))}})
+	assert.True(t, errors.Is(err, errors.ErrInternal))
+}
+
+func TestConnectRetry(t *testing.T) {
+	port := freePort(t)
+	cfg := &Config{
+		Address:       []string{fmt.Sprintf("nats://127.0.0.1:%d", port)},
+		ConnectMode:   ConnectModeRetry,
+		ReconnectWait: 50 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := NewClientContext(ctx, cfg)
+	assert.True(t, errors.Is(err, errors.ErrInternal))
+
+	time.AfterFunc(200*time.Millisecond, func() { runServerOnPort(t, port) })
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := NewClientContext(ctx, cfg)
+	require.NoError(t, err)
+	assert.True(t, c.natsConn.IsConnected())
+	assert.NoError(t, c.Close(ctx))
+}
+
+func TestConnectLazy(t *testing.T) {
+	port := freePort(t)
+	c, err := NewClient(&Config{
+		Address:       []string{fmt.Sprintf("nats://127.0.0.1:%d", port)},
+		ConnectMode:   ConnectModeLazy,
+		MaxReconnects: -1,
+		ReconnectWait: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer c.Close(context.Background())
+	assert.False(t, c.natsConn.IsConnected())
+
+	got := make(chan string, 3)
+	_, err = c.Sub("lazy", func(ctx context.Context, msg *nats.Msg) error {
+		got <- string(msg.Data)
+		return nil
+	})
+	require.NoError(t, err)
+
+	// publishes before the first connect are buffered and sent in order
+	require.NoError(t, c.Pub(context.Background(), "lazy", nil, []byte("1")))
+	require.NoError(t, c.Pub(context.Background(), "lazy", nil, []byte("2")))
+	_, err = c.Request(context.Background(), "lazy", nil, nil)
+	assert.Contains(t, err.Error(), "not connected yet")
+
+	runServerOnPort(t, port)
+	assert.Eventually(t, c.natsConn.IsConnected, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, c.Pub(context.Background(), "lazy", nil, []byte("3")))
+	for _, want := range []string{"1", "2", "3"} {
+		select {
+		case data := <-got:
+			assert.Equal(t, want, data)
+		case <-time.After(5 * time.Second):
+			t.Fatal("subscription was not replayed after connect")
+		}
+	}
+}
+
+func TestConnectLazyBufferFull(t *testing.T) {
+	c, err := NewClient(&Config{
+		Address:          []string{fmt.Sprintf("nats://127.0.0.1:%d", freePort(t))},
+		ConnectMode:      ConnectModeLazy,
+		ReconnectBufSize: 1024,
+	})
+	require.NoError(t, err)
+	defer c.Close(context.Background())
+
+	require.NoError(t, c.Pub(context.Background(), "lazy", nil, make([]byte, 100)))
+	err = c.Pub(context.Background(), "lazy", nil, make([]byte, 1024))
+	assert.True(t, errors.Is(err, errors.ErrInternal))
+	assert.Contains(t, err.Error(), "buffer")
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	c := newTestClient(t)
+
+	remaining := make(chan time.Duration, 3)
+	record := func(ctx context.Context, msg *nats.Msg) error {
+		deadline, _ := ctx.Deadline()
+		remaining <- time.Until(deadline)
+		return nil
+	}
+	_, err := c.Sub("default", record)
+	require.NoError(t, err)
+	_, err = c.Sub("short", record, WithHandlerTimeout(200*time.Millisecond))
+	require.NoError(t, err)
+	_, err = c.RegisterChannel([]Channel{{ChannelName: "channel", Handler: record, Timeout: 5 * time.Minute}})
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		Subject string
+		Min     time.Duration
+		Max     time.Duration
+	}{
+		{"default", 29 * time.Second, DefaultHandlerTimeout},
+		{"short", 100 * time.Millisecond, 200 * time.Millisecond},
+		{"channel", 4 * time.Minute, 5 * time.Minute},
+	} {
+		require.NoError(t, c.Pub(context.Background(), test.Subject, nil, nil))
+		select {
+		case d := <-remaining:
+			assert.True(t, test.Min < d && d <= test.Max, "%s: %s", test.Subject, d)
+		case <-time.After(5 * time.Second):
+			t.Fatal("message was not handled", test.Subject)
+		}
+	}
+}
+
+func TestHandlerDeadlineHeader(t *testing.T) {
+	c := newTestClient(t)
+
+	remaining := make(chan time.Duration, 1)
+	_, err := c.Sub("deadline", func(ctx context.Context, msg *nats.Msg) error {
+		deadline, _ := ctx.Deadline()
+		remaining <- time.Until(deadline)
+		return nil
+	}, WithHandlerTimeout(time.Minute))
+	require.NoError(t, err)
+
+	deadline := time.Now().Add(time.Second).UnixNano() / 1e6
+	require.NoError(t, c.Pub(context.Background(), "deadline", map[string][]string{HeaderDeadline: {fmt.Sprint(deadline)}}, nil))
+	select {
+	case d := <-remaining:
+		assert.True(t, d <= time.Second, d)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not handled")
+	}
+}
+
+func TestHandlerContextCancelledOnClose(t *testing.T) {
+	c := newTestClient(t)
+
+	started, done := make(chan struct{}), make(chan error, 1)
+	_, err := c.Sub("block", func(ctx context.Context, msg *nats.Msg) error {
+		close(started)
+		<-ctx.Done()
+		done <- ctx.Err()
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.Pub(context.Background(), "block", nil, nil))
+	<-started
+
+	assert.NoError(t, c.Close(context.Background()))
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler context was not cancelled")
+	}
+}
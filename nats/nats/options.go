@@ -0,0 +1,113 @@
+package nats
+
+import (
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Option configures the Client created by NewClient, options run in order before connecting
+type Option func(c *Client)
+
+// WithLogger logs the client and its handlers with logger instead of the global zerolog logger.
+// Handlers get it from log.Ctx(ctx).
+func WithLogger(logger zerolog.Logger) Option {
+	return func(c *Client) {
+		c.baseLogger = &logger
+	}
+}
+
+// WithMetrics records the client metrics to m, see SetMetrics
+func WithMetrics(m Metrics) Option {
+	return func(c *Client) {
+		c.SetMetrics(m)
+	}
+}
+
+// WithSpanExporter exports the producer and consumer spans to e, see SetSpanExporter
+func WithSpanExporter(e SpanExporter) Option {
+	return func(c *Client) {
+		c.SetSpanExporter(e)
+	}
+}
+
+// WithPropagator propagates the trace context with p, see SetPropagator
+func WithPropagator(p propagation.TextMapPropagator) Option {
+	return func(c *Client) {
+		c.SetPropagator(p)
+	}
+}
+
+// WithCodec uses codec for PubTyped instead of Config.ContentType and for the Typed handlers of the client.
+// Unlike RegisterCodec it only applies to this client, the other content types fall back to the registered codecs.
+func WithCodec(codec Codec) Option {
+	return func(c *Client) {
+		if c.codecs == nil {
+			c.codecs = map[string]Codec{}
+		}
+		c.codecs[codec.ContentType()] = codec
+		c.contentType = codec.ContentType()
+	}
+}
+
+// WithClientMiddlewares appends mws to DefaultMiddlewares, see Use
+func WithClientMiddlewares(mws ...Middleware) Option {
+	return func(c *Client) {
+		c.Use(mws...)
+	}
+}
+
+// WithInterceptors appends ics to DefaultInterceptors, see UseInterceptors
+func WithInterceptors(ics ...Interceptor) Option {
+	return func(c *Client) {
+		c.UseInterceptors(ics...)
+	}
+}
+
+// WithDefaultHandlerTimeout overrides Config.HandlerTimeout
+func WithDefaultHandlerTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.cfg.HandlerTimeout = timeout
+	}
+}
+
+// WithFlushTimeout overrides Config.FlushTimeout
+func WithFlushTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.cfg.FlushTimeout = timeout
+	}
+}
+
+// WithCompression compresses the published messages over threshold bytes with encoding, see CompressionConfig
+func WithCompression(encoding string, threshold int) Option {
+	return func(c *Client) {
+		c.cfg.Compression.Encoding = encoding
+		c.cfg.Compression.Threshold = threshold
+	}
+}
+
+// WithConnEvents overrides Config.Events
+func WithConnEvents(events ConnEvents) Option {
+	return func(c *Client) {
+		c.cfg.Events = events
+	}
+}
+
+// WithErrorHandler is called for the asynchronous errors of the connection, e.g. slow consumers,
+// sub may be nil. It overrides Config.Events.AsyncError.
+func WithErrorHandler(fn func(conn *nats.Conn, sub *nats.Subscription, err error)) Option {
+	return func(c *Client) {
+		c.cfg.Events.AsyncError = fn
+	}
+}
+
+// WithConn uses conn instead of connecting with the Config, mostly for tests.
+// Its reconnect, disconnect, closed, discovered servers and error handlers are replaced by the client ones,
+// Config.Address defaults to conn.Servers(). Closing the client closes conn.
+func WithConn(conn *nats.Conn) Option {
+	return func(c *Client) {
+		c.natsConn = conn
+	}
+}
@@ -0,0 +1,174 @@
+package nats
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+type upperCodec struct{}
+
+func (upperCodec) ContentType() string { return "text/upper" }
+
+func (upperCodec) Marshal(v interface{}) ([]byte, error) {
+	return []byte(strings.ToUpper(v.(string))), nil
+}
+
+func (upperCodec) Unmarshal(data []byte, v interface{}) error {
+	*(v.(*string)) = string(data)
+	return nil
+}
+
+func TestNewClientOptions(t *testing.T) {
+	s := runServer(t, false)
+	nc, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+
+	var out syncBuffer
+	metrics := NewPrometheusMetrics("test")
+	exporter := NewInMemoryExporter()
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, msg *nats.Msg) error {
+				order = append(order, name)
+				return next(ctx, msg)
+			}
+		}
+	}
+
+	c, err := NewClient(&Config{},
+		WithConn(nc),
+		WithLogger(zerolog.New(&out)),
+		WithMetrics(metrics),
+		WithSpanExporter(exporter),
+		WithCodec(upperCodec{}),
+		WithDefaultHandlerTimeout(time.Minute),
+		WithClientMiddlewares(mark("a"), mark("b")),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []string{s.ClientURL()}, c.cfg.Address)
+
+	type received struct {
+		data     string
+		header   string
+		deadline time.Duration
+	}
+	got := make(chan received, 1)
+	_, err = c.Sub("options", func(ctx context.Context, msg *nats.Msg) error {
+		deadline, _ := ctx.Deadline()
+		log.Ctx(ctx).Info().Msg("from handler")
+		got <- received{data: string(msg.Data), header: msg.Header.Get(HeaderContentType), deadline: time.Until(deadline)}
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.PubTyped(context.Background(), "options", "hello"))
+
+	var r received
+	select {
+	case r = <-got:
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not handled")
+	}
+	assert.Equal(t, "HELLO", r.data)
+	assert.Equal(t, "text/upper", r.header)
+	assert.True(t, r.deadline > 30*time.Second)
+	assert.Equal(t, []string{"a", "b"}, order)
+
+	require.Eventually(t, func() bool { return len(exporter.Spans()) == 2 }, time.Second, 10*time.Millisecond)
+	var exposition bytes.Buffer
+	_, err = metrics.WriteTo(&exposition)
+	require.NoError(t, err)
+	assert.Contains(t, exposition.String(), `test_nats_published_total{subject="options"} 1`)
+
+	// the handler logger carries the message fields
+	var line map[string]interface{}
+	for _, l := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if strings.Contains(l, "from handler") {
+			require.NoError(t, json.Unmarshal([]byte(l), &line))
+		}
+	}
+	require.NotNil(t, line)
+	assert.Equal(t, "options", line["endpoint"])
+	assert.NotEmpty(t, line["request_id"])
+
+	require.NoError(t, c.Close(context.Background()))
+	assert.True(t, nc.IsClosed())
+}
+
+func TestNewClientWithConnEvents(t *testing.T) {
+	s := runServer(t, false)
+	nc, err := nats.Connect(s.ClientURL())
+	require.NoError(t, err)
+
+	closed := make(chan struct{})
+	asyncErrs := make(chan error, 1)
+	c, err := NewClient(&Config{},
+		WithConn(nc),
+		WithConnEvents(ConnEvents{Closed: func(conn *nats.Conn) { close(closed) }}),
+		WithErrorHandler(func(conn *nats.Conn, sub *nats.Subscription, err error) {
+			select {
+			case asyncErrs <- err:
+			default:
+			}
+		}),
+	)
+	require.NoError(t, err)
+
+	release := make(chan struct{})
+	sub, err := c.Sub("options.slow", func(ctx context.Context, msg *nats.Msg) error {
+		<-release
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, sub.SetPendingLimits(1, -1))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, c.Pub(context.Background(), "options.slow", nil, nil))
+	}
+	select {
+	case err := <-asyncErrs:
+		assert.Equal(t, nats.ErrSlowConsumer, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("error handler not called")
+	}
+	close(release)
+
+	require.NoError(t, c.Close(context.Background()))
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("closed event not triggered")
+	}
+}
+
+func TestNewClientInvalidOption(t *testing.T) {
+	_, err := NewClient(&Config{Address: []string{"nats://127.0.0.1:4222"}}, WithDefaultHandlerTimeout(-time.Second))
+	assert.Error(t, err)
+}
@@ -0,0 +1,301 @@
+package nats
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+// DefaultBuckets are the latency histogram buckets in seconds, the same as the Prometheus client defaults
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+type metricSeries struct {
+	labels  []string
+	value   float64
+	buckets []uint64 // histogram: count per bucket, not cumulative
+	count   uint64
+	sum     float64
+}
+
+type metricFamily struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	series map[string]*metricSeries
+}
+
+// PrometheusMetrics implements Metrics and serves them in the Prometheus text format,
+// mount it on the /metrics endpoint scraped by Prometheus.
+type PrometheusMetrics struct {
+	buckets []float64
+
+	mu       sync.Mutex
+	families []*metricFamily
+
+	publishes     *metricFamily
+	publishErrors *metricFamily
+	publishTime   *metricFamily
+	received      *metricFamily
+	handleTime    *metricFamily
+	handleErrors  *metricFamily
+	inFlight      *metricFamily
+	pendingMsgs   *metricFamily
+	pendingBytes  *metricFamily
+	reconnects    *metricFamily
+	disconnects   *metricFamily
+	slowConsumers *metricFamily
+}
+
+// NewPrometheusMetrics names every metric namespace_nats_xxx (nats_xxx without namespace),
+// buckets are the latency histogram buckets in seconds, DefaultBuckets when empty.
+func NewPrometheusMetrics(namespace string, buckets ...float64) *PrometheusMetrics {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	prefix := "nats_"
+	if namespace != "" {
+		prefix = namespace + "_" + prefix
+	}
+	m := &PrometheusMetrics{buckets: buckets}
+	family := func(name, typ, help string, labels ...string) *metricFamily {
+		f := &metricFamily{name: prefix + name, help: help, typ: typ, labels: labels, series: map[string]*metricSeries{}}
+		m.families = append(m.families, f)
+		return f
+	}
+	m.publishes = family("published_total", metricCounter, "Messages published.", "subject")
+	m.publishErrors = family("publish_failures_total", metricCounter, "Publishes that failed, by exception code.", "subject", "code")
+	m.publishTime = family("publish_duration_seconds", metricHistogram, "Publish latency in seconds.", "subject")
+	m.received = family("received_total", metricCounter, "Messages handed to a channel.", "subject", "group")
+	m.handleTime = family("handler_duration_seconds", metricHistogram, "Handler duration in seconds, including retries.", "subject", "group")
+	m.handleErrors = family("handler_errors_total", metricCounter, "Handler errors, by exception code.", "subject", "group", "code")
+	m.inFlight = family("handlers_in_flight", metricGauge, "Handlers running.", "subject", "group")
+	m.pendingMsgs = family("pending_messages", metricGauge, "Messages waiting in the subscription buffer.", "subject", "group")
+	m.pendingBytes = family("pending_bytes", metricGauge, "Bytes waiting in the subscription buffer.", "subject", "group")
+	m.reconnects = family("reconnects_total", metricCounter, "Reconnects to the nats server.")
+	m.disconnects = family("disconnects_total", metricCounter, "Disconnects from the nats server.")
+	m.slowConsumers = family("slow_consumers_total", metricCounter, "Slow consumer events, messages were dropped.", "subject")
+	return m
+}
+
+// get returns the series of labels, m.mu must be held
+func (m *PrometheusMetrics) get(f *metricFamily, labels ...string) *metricSeries {
+	key := strings.Join(labels, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labels: labels}
+		if f.typ == metricHistogram {
+			s.buckets = make([]uint64, len(m.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (m *PrometheusMetrics) add(f *metricFamily, v float64, labels ...string) {
+	m.mu.Lock()
+	m.get(f, labels...).value += v
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) set(f *metricFamily, v float64, labels ...string) {
+	m.mu.Lock()
+	m.get(f, labels...).value = v
+	m.mu.Unlock()
+}
+
+func (m *PrometheusMetrics) observe(f *metricFamily, d time.Duration, labels ...string) {
+	v := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(f, labels...)
+	s.count++
+	s.sum += v
+	if i := sort.SearchFloat64s(m.buckets, v); i < len(m.buckets) {
+		s.buckets[i]++
+	}
+}
+
+// Published implement Metrics
+func (m *PrometheusMetrics) Published(subject string, d time.Duration, err error) {
+	m.add(m.publishes, 1, subject)
+	m.observe(m.publishTime, d, subject)
+	if err != nil {
+		m.add(m.publishErrors, 1, subject, errors.Code(err))
+	}
+}
+
+// Received implement Metrics
+func (m *PrometheusMetrics) Received(subject, group string) {
+	m.add(m.received, 1, subject, group)
+}
+
+// Handled implement Metrics
+func (m *PrometheusMetrics) Handled(subject, group string, d time.Duration, err error) {
+	m.observe(m.handleTime, d, subject, group)
+	if err != nil {
+		m.add(m.handleErrors, 1, subject, group, errors.Code(err))
+	}
+}
+
+// InFlight implement Metrics
+func (m *PrometheusMetrics) InFlight(subject, group string, delta int) {
+	m.add(m.inFlight, float64(delta), subject, group)
+}
+
+// Pending implement Metrics
+func (m *PrometheusMetrics) Pending(subject, group string, msgs, bytes int) {
+	m.set(m.pendingMsgs, float64(msgs), subject, group)
+	m.set(m.pendingBytes, float64(bytes), subject, group)
+}
+
+// Reconnected implement Metrics
+func (m *PrometheusMetrics) Reconnected() {
+	m.add(m.reconnects, 1)
+}
+
+// Disconnected implement Metrics
+func (m *PrometheusMetrics) Disconnected() {
+	m.add(m.disconnects, 1)
+}
+
+// SlowConsumer implement Metrics
+func (m *PrometheusMetrics) SlowConsumer(subject string) {
+	m.add(m.slowConsumers, 1, subject)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	for _, f := range m.snapshot() {
+		if len(f.series) == 0 && len(f.labels) > 0 {
+			continue
+		}
+		cw.write("# HELP ", f.name, " ", f.help, "\n")
+		cw.write("# TYPE ", f.name, " ", f.typ, "\n")
+		if len(f.series) == 0 {
+			cw.write(f.name, " 0\n")
+			continue
+		}
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			m.writeSeries(cw, f, f.series[k])
+		}
+	}
+	if err := cw.w.Flush(); err != nil && cw.err == nil {
+		cw.err = err
+	}
+	return cw.n, cw.err
+}
+
+// snapshot copies the families and their series, WriteTo formats the copy without m.mu
+// so a slow scraper does not block the publishes and handlers
+func (m *PrometheusMetrics) snapshot() []*metricFamily {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	families := make([]*metricFamily, 0, len(m.families))
+	for _, f := range m.families {
+		cf := *f
+		cf.series = make(map[string]*metricSeries, len(f.series))
+		for k, s := range f.series {
+			cs := *s
+			cs.buckets = append([]uint64(nil), s.buckets...)
+			cf.series[k] = &cs
+		}
+		families = append(families, &cf)
+	}
+	return families
+}
+
+func (m *PrometheusMetrics) writeSeries(cw *countWriter, f *metricFamily, s *metricSeries) {
+	if f.typ != metricHistogram {
+		cw.write(f.name, labelString(f.labels, s.labels, "", ""), " ", formatFloat(s.value), "\n")
+		return
+	}
+	var cumulative uint64
+	for i, le := range m.buckets {
+		cumulative += s.buckets[i]
+		cw.write(f.name, "_bucket", labelString(f.labels, s.labels, "le", formatFloat(le)), " ", strconv.FormatUint(cumulative, 10), "\n")
+	}
+	cw.write(f.name, "_bucket", labelString(f.labels, s.labels, "le", "+Inf"), " ", strconv.FormatUint(s.count, 10), "\n")
+	cw.write(f.name, "_sum", labelString(f.labels, s.labels, "", ""), " ", formatFloat(s.sum), "\n")
+	cw.write(f.name, "_count", labelString(f.labels, s.labels, "", ""), " ", strconv.FormatUint(s.count, 10), "\n")
+}
+
+// ServeHTTP serves the metrics to the Prometheus scraper
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = m.WriteTo(w)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelString(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	if extraName != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extraName)
+		b.WriteString(`="`)
+		b.WriteString(extraValue)
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// countWriter writes strings and remembers the bytes written and the first error
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) write(parts ...string) {
+	for _, p := range parts {
+		if cw.err != nil {
+			return
+		}
+		n, err := cw.w.WriteString(p)
+		cw.n += int64(n)
+		cw.err = err
+	}
+}
@@ -0,0 +1,155 @@
+package nats
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+func TestPrometheusMetricsExposition(t *testing.T) {
+	m := NewPrometheusMetrics("order", 0.1, 1)
+	m.Published("orders.created", 50*time.Millisecond, nil)
+	m.Published("orders.created", 2*time.Second, errors.Wrapf(errors.ErrInternal, "timeout"))
+	m.Handled("orders.*", "workers", 500*time.Millisecond, errors.ErrInvalidInput)
+	m.InFlight("orders.*", "workers", 1)
+	m.Pending("orders.*", "workers", 3, 300)
+	m.Reconnected()
+	m.SlowConsumer(`a"b`)
+
+	var b bytes.Buffer
+	n, err := m.WriteTo(&b)
+	require.NoError(t, err)
+	assert.Equal(t, int64(b.Len()), n)
+	out := b.String()
+
+	for _, line := range []string{
+		"# TYPE order_nats_published_total counter",
+		`order_nats_published_total{subject="orders.created"} 2`,
+		`order_nats_publish_failures_total{subject="orders.created",code="500001"} 1`,
+		"# TYPE order_nats_publish_duration_seconds histogram",
+		`order_nats_publish_duration_seconds_bucket{subject="orders.created",le="0.1"} 1`,
+		`order_nats_publish_duration_seconds_bucket{subject="orders.created",le="1"} 1`,
+		`order_nats_publish_duration_seconds_bucket{subject="orders.created",le="+Inf"} 2`,
+		`order_nats_publish_duration_seconds_sum{subject="orders.created"} 2.05`,
+		`order_nats_publish_duration_seconds_count{subject="orders.created"} 2`,
+		`order_nats_handler_errors_total{subject="orders.*",group="workers",code="400001"} 1`,
+		`order_nats_handlers_in_flight{subject="orders.*",group="workers"} 1`,
+		`order_nats_pending_bytes{subject="orders.*",group="workers"} 300`,
+		"order_nats_reconnects_total 1",
+		"order_nats_disconnects_total 0",
+		`order_nats_slow_consumers_total{subject="a\"b"} 1`,
+	} {
+		assert.Contains(t, out, line+"\n")
+	}
+	assert.NotContains(t, out, "order_nats_received_total")
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, out, rec.Body.String())
+	assert.Contains(t, rec.Header().Get("Content-Type"), "version=0.0.4")
+}
+
+func TestClientMetrics(t *testing.T) {
+	c := newTestClient(t)
+	m := NewPrometheusMetrics("")
+	c.SetMetrics(m)
+
+	done := make(chan struct{}, 2)
+	_, err := c.RegisterChannel([]Channel{{
+		ChannelName: "metrics.*",
+		GroupName:   "workers",
+		Handler: func(ctx context.Context, msg *nats.Msg) error {
+			defer func() { done <- struct{}{} }()
+			if msg.Subject == "metrics.bad" {
+				return errors.Wrapf(errors.ErrInvalidInput, "bad")
+			}
+			return nil
+		},
+	}})
+	require.NoError(t, err)
+
+	require.NoError(t, c.Pub(context.Background(), "metrics.ok", nil, nil))
+	require.NoError(t, c.Pub(context.Background(), "metrics.bad", nil, nil))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("message not handled")
+		}
+	}
+
+	var b bytes.Buffer
+	require.Eventually(t, func() bool {
+		b.Reset()
+		_, _ = m.WriteTo(&b)
+		return bytes.Contains(b.Bytes(), []byte(`nats_handler_duration_seconds_count{subject="metrics.*",group="workers"} 2`))
+	}, time.Second, 10*time.Millisecond)
+	out := b.String()
+	assert.Contains(t, out, `nats_published_total{subject="metrics.ok"} 1`)
+	assert.Contains(t, out, `nats_received_total{subject="metrics.*",group="workers"} 2`)
+	assert.Contains(t, out, `nats_handler_errors_total{subject="metrics.*",group="workers",code="400001"} 1`)
+	assert.Contains(t, out, `nats_handlers_in_flight{subject="metrics.*",group="workers"} 0`)
+
+	c.SetMetrics(nil)
+	assert.Equal(t, NopMetrics{}, c.Metrics())
+}
+
+// blockedWriter blocks every write until release is closed
+type blockedWriter struct {
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w *blockedWriter) Write(p []byte) (int, error) {
+	select {
+	case w.writing <- struct{}{}:
+	default:
+	}
+	<-w.release
+	return len(p), nil
+}
+
+func TestPrometheusMetricsSlowScraper(t *testing.T) {
+	m := NewPrometheusMetrics("test")
+	m.Published("orders", time.Millisecond, nil)
+	// enough series to overflow the write buffer before the last family
+	for i := 0; i < 100; i++ {
+		m.Published(fmt.Sprintf("orders.%d", i), time.Millisecond, nil)
+	}
+
+	w := &blockedWriter{writing: make(chan struct{}, 1), release: make(chan struct{})}
+	written := make(chan struct{})
+	go func() {
+		_, _ = m.WriteTo(w)
+		close(written)
+	}()
+	<-w.writing
+
+	recorded := make(chan struct{})
+	go func() {
+		m.Published("orders", time.Millisecond, nil)
+		m.Handled("orders", "", time.Millisecond, nil)
+		close(recorded)
+	}()
+	select {
+	case <-recorded:
+	case <-time.After(time.Second):
+		t.Fatal("metrics blocked by a slow scraper")
+	}
+	close(w.release)
+	<-written
+
+	var exposition bytes.Buffer
+	_, err := m.WriteTo(&exposition)
+	require.NoError(t, err)
+	assert.Contains(t, exposition.String(), `test_nats_published_total{subject="orders"} 2`)
+}
@@ -0,0 +1,250 @@
+package nats
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+const (
+	// flushWait is the flush timeout when Config.FlushTimeout is not set and the context has no deadline
+	flushWait = 10 * time.Second
+
+	DefaultAsyncBatchSize = 256
+	DefaultAsyncLinger    = 5 * time.Millisecond
+)
+
+func (c *Client) flushTimeout() time.Duration {
+	if c.cfg.FlushTimeout > 0 {
+		return c.cfg.FlushTimeout
+	}
+	return flushWait
+}
+
+// Flush 等待之前推送的訊息都送到 server, ctx 沒有 deadline 時最多等 Config.FlushTimeout (未設定為 10s)
+func (c *Client) Flush(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.flushTimeout())
+		defer cancel()
+	}
+	if err := c.natsConn.FlushWithContext(ctx); err != nil {
+		return errors.Wrapf(errors.ErrInternal, "fail to flush nats connection, err: %s", err.Error())
+	}
+	return nil
+}
+
+// PubBatch 依序推送 msgs 後 Flush 一次, msgs 的 Header 不會被修改.
+// 推送失敗時停止並回傳 error, 之前的訊息仍會送出.
+func (c *Client) PubBatch(ctx context.Context, msgs []*nats.Msg) error {
+	for i, m := range msgs {
+		err := c.publish(ctx, newMsg(m.Subject, m.Header, m.Data), func(ctx context.Context, msg *nats.Msg) error {
+			return c.publishMsg(msg)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "batch stopped at message %d of %d", i+1, len(msgs))
+		}
+	}
+	return c.Flush(ctx)
+}
+
+// PubFuture is the result of AsyncPublisher.Pub, it is done once the message reached the server or failed
+type PubFuture struct {
+	done chan struct{}
+	err  error
+}
+
+func newPubFuture() *PubFuture {
+	return &PubFuture{done: make(chan struct{})}
+}
+
+func (f *PubFuture) resolve(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// Done is closed once the future is resolved
+func (f *PubFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns the publish or flush error once Done is closed, nil before
+func (f *PubFuture) Err() error {
+	select {
+	case <-f.done:
+		return f.err
+	default:
+		return nil
+	}
+}
+
+// Wait waits for the future and returns its error, or an error when ctx ends first
+func (f *PubFuture) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return errors.Wrapf(errors.ErrInternal, "fail to wait for publish, err: %s", ctx.Err().Error())
+	}
+}
+
+// AsyncPublisher 推送時不等待 server, 由背景 goroutine 在 Linger 後或累積 BatchSize 筆時 Flush,
+// Flush 完成後 resolve 這批訊息的 PubFuture. 關閉 Client 前應先呼叫 Close.
+type AsyncPublisher struct {
+	c         *Client
+	batchSize int
+	linger    time.Duration
+
+	mu      sync.Mutex
+	pending []*PubFuture
+	closed  bool
+	// publishing counts the Pub calls past the closed check, Close waits for them before the last flush
+	publishing sync.WaitGroup
+
+	kick    chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// AsyncOption configures NewAsyncPublisher
+type AsyncOption func(p *AsyncPublisher)
+
+// WithBatchSize flushes as soon as size messages are waiting, default DefaultAsyncBatchSize
+func WithBatchSize(size int) AsyncOption {
+	return func(p *AsyncPublisher) {
+		p.batchSize = size
+	}
+}
+
+// WithLinger is how long the first waiting message waits for others before the flush, default DefaultAsyncLinger
+func WithLinger(linger time.Duration) AsyncOption {
+	return func(p *AsyncPublisher) {
+		p.linger = linger
+	}
+}
+
+// NewAsyncPublisher starts an AsyncPublisher, stop it with Close
+func (c *Client) NewAsyncPublisher(opts ...AsyncOption) *AsyncPublisher {
+	p := &AsyncPublisher{
+		c:         c,
+		batchSize: DefaultAsyncBatchSize,
+		linger:    DefaultAsyncLinger,
+		kick:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.batchSize <= 0 {
+		p.batchSize = DefaultAsyncBatchSize
+	}
+	go p.run()
+	return p
+}
+
+// Pub 推送訊息並回傳 PubFuture, interceptors 在呼叫端的 goroutine 執行.
+// 推送失敗或 AsyncPublisher 已關閉時回傳已完成的 PubFuture.
+func (p *AsyncPublisher) Pub(ctx context.Context, subject string, header map[string][]string, data []byte) *PubFuture {
+	f := newPubFuture()
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		f.resolve(errors.Wrapf(errors.ErrInternal, "async publisher is closed"))
+		return f
+	}
+	p.publishing.Add(1)
+	p.mu.Unlock()
+	defer p.publishing.Done()
+
+	// the interceptors and the publish run without the lock, the future waits for a flush after the publish
+	err := p.c.publish(ctx, newMsg(subject, header, data), func(ctx context.Context, msg *nats.Msg) error {
+		return p.c.publishMsg(msg)
+	})
+	if err != nil {
+		f.resolve(err)
+		return f
+	}
+
+	p.mu.Lock()
+	p.pending = append(p.pending, f)
+	n := len(p.pending)
+	p.mu.Unlock()
+	if n == 1 || n >= p.batchSize {
+		select {
+		case p.kick <- struct{}{}:
+		default:
+		}
+	}
+	return f
+}
+
+// Flush 等待之前推送的訊息都送到 server 並 resolve 它們的 PubFuture
+func (p *AsyncPublisher) Flush(ctx context.Context) error {
+	return p.flush(ctx)
+}
+
+// Close 停止接受新訊息, Flush 已推送的訊息後停止背景 goroutine. ctx 結束時回傳 error, 背景 goroutine 仍會完成 Flush.
+func (p *AsyncPublisher) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		go func() {
+			p.publishing.Wait()
+			close(p.stop)
+		}()
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-p.stopped:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrapf(errors.ErrInternal, "fail to close async publisher, err: %s", ctx.Err().Error())
+	}
+}
+
+func (p *AsyncPublisher) run() {
+	defer close(p.stopped)
+	for {
+		select {
+		case <-p.kick:
+		case <-p.stop:
+			_ = p.flush(context.Background())
+			return
+		}
+		if p.linger > 0 && p.pendingCount() < p.batchSize {
+			timer := time.NewTimer(p.linger)
+			select {
+			case <-timer.C:
+			case <-p.kick:
+			case <-p.stop:
+			}
+			timer.Stop()
+		}
+		_ = p.flush(context.Background())
+	}
+}
+
+func (p *AsyncPublisher) pendingCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pending)
+}
+
+// flush takes the waiting futures, flushes the connection and resolves them with its error
+func (p *AsyncPublisher) flush(ctx context.Context) error {
+	p.mu.Lock()
+	batch := p.pending
+	p.pending = nil
+	p.mu.Unlock()
+
+	err := p.c.Flush(ctx)
+	for _, f := range batch {
+		f.resolve(err)
+	}
+	return err
+}
@@ -0,0 +1,275 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+func subscribeRaw(t testing.TB, url, subject string) *nats.Subscription {
+	nc, err := nats.Connect(url)
+	require.NoError(t, err)
+	t.Cleanup(nc.Close)
+	sub, err := nc.SubscribeSync(subject)
+	require.NoError(t, err)
+	require.NoError(t, nc.Flush())
+	return sub
+}
+
+func TestPubFlushTimeout(t *testing.T) {
+	port := freePort(t)
+	s := runServerOnPort(t, port)
+	address := []string{fmt.Sprintf("nats://127.0.0.1:%d", port)}
+	buffered, err := NewClient(&Config{Address: address, MaxReconnects: -1})
+	require.NoError(t, err)
+	defer buffered.Close(context.Background())
+	flushed, err := NewClient(&Config{Address: address, MaxReconnects: -1}, WithFlushTimeout(100*time.Millisecond))
+	require.NoError(t, err)
+	defer flushed.Close(context.Background())
+
+	require.NoError(t, flushed.Pub(context.Background(), "flush", nil, nil))
+	require.NoError(t, flushed.Flush(context.Background()))
+
+	s.Shutdown()
+	require.Eventually(t, func() bool { return !flushed.natsConn.IsConnected() }, 2*time.Second, 10*time.Millisecond)
+	// the message is kept in the reconnect buffer, only the flush tells it did not reach the server
+	assert.NoError(t, buffered.Pub(context.Background(), "flush", nil, nil))
+	err = flushed.Pub(context.Background(), "flush", nil, nil)
+	assert.True(t, errors.Is(err, errors.ErrInternal), err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, buffered.Flush(ctx))
+}
+
+func TestPubBatch(t *testing.T) {
+	s := runServer(t, false)
+	c, err := NewClient(&Config{Address: []string{s.ClientURL()}})
+	require.NoError(t, err)
+	defer c.Close(context.Background())
+	sub := subscribeRaw(t, s.ClientURL(), "batch.>")
+
+	header := nats.Header{"k": {"v"}}
+	var msgs []*nats.Msg
+	for i := 0; i < 10; i++ {
+		msgs = append(msgs, &nats.Msg{Subject: "batch." + strconv.Itoa(i), Header: header, Data: []byte(strconv.Itoa(i))})
+	}
+	msgs = append(msgs, &nats.Msg{Subject: "batch.nil_header"})
+	require.NoError(t, c.PubBatch(context.Background(), msgs))
+	assert.Equal(t, nats.Header{"k": {"v"}}, header)
+
+	for i := 0; i < 10; i++ {
+		msg, err := sub.NextMsg(time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, strconv.Itoa(i), string(msg.Data))
+		assert.Equal(t, "v", msg.Header.Get("k"))
+		assert.NotEmpty(t, msg.Header.Get("request_id"))
+	}
+	msg, err := sub.NextMsg(time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "batch.nil_header", msg.Subject)
+
+	err = c.PubBatch(context.Background(), []*nats.Msg{{Subject: "batch.ok"}, {Subject: ""}})
+	assert.True(t, errors.Is(err, errors.ErrInternal))
+	assert.Contains(t, err.Error(), "message 2 of 2")
+}
+
+func TestAsyncPublisher(t *testing.T) {
+	s := runServer(t, false)
+	c, err := NewClient(&Config{Address: []string{s.ClientURL()}})
+	require.NoError(t, err)
+	defer c.Close(context.Background())
+	sub := subscribeRaw(t, s.ClientURL(), "async")
+
+	p := c.NewAsyncPublisher()
+	var futures []*PubFuture
+	for i := 0; i < 1000; i++ {
+		futures = append(futures, p.Pub(context.Background(), "async", nil, []byte(strconv.Itoa(i))))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for _, f := range futures {
+		require.NoError(t, f.Wait(ctx))
+	}
+	for i := 0; i < 1000; i++ {
+		msg, err := sub.NextMsg(time.Second)
+		require.NoError(t, err)
+		require.Equal(t, strconv.Itoa(i), string(msg.Data))
+	}
+
+	f := p.Pub(context.Background(), "async", nil, nil)
+	require.NoError(t, p.Flush(context.Background()))
+	assert.NoError(t, f.Err())
+
+	require.NoError(t, p.Close(context.Background()))
+	f = p.Pub(context.Background(), "async", nil, nil)
+	<-f.Done()
+	assert.True(t, errors.Is(f.Err(), errors.ErrInternal))
+}
+
+func TestAsyncPublisherBatchSize(t *testing.T) {
+	c := newTestClient(t)
+	p := c.NewAsyncPublisher(WithBatchSize(10), WithLinger(time.Hour))
+	defer p.Close(context.Background())
+
+	first := p.Pub(context.Background(), "async.batch", nil, nil)
+	select {
+	case <-first.Done():
+		t.Fatal("flushed before the batch is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.NoError(t, first.Err())
+
+	var last *PubFuture
+	for i := 1; i < 10; i++ {
+		last = p.Pub(context.Background(), "async.batch", nil, nil)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, last.Wait(ctx))
+	assert.NoError(t, first.Wait(ctx))
+}
+
+func TestAsyncPublisherCloseFlushes(t *testing.T) {
+	c := newTestClient(t)
+	p := c.NewAsyncPublisher(WithLinger(time.Hour))
+	f := p.Pub(context.Background(), "async.close", nil, nil)
+	require.NoError(t, p.Close(context.Background()))
+	select {
+	case <-f.Done():
+		assert.NoError(t, f.Err())
+	default:
+		t.Fatal("future not resolved by Close")
+	}
+}
+
+func TestAsyncPublisherSlowInterceptor(t *testing.T) {
+	c := newTestClient(t)
+	release := make(chan struct{})
+	c.UseInterceptors(func(next Publisher) Publisher {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			if msg.Subject == "async.slow" {
+				<-release
+			}
+			return next(ctx, msg)
+		}
+	})
+	p := c.NewAsyncPublisher()
+
+	slow := make(chan *PubFuture, 1)
+	go func() {
+		slow <- p.Pub(context.Background(), "async.slow", nil, nil)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// a slow interceptor does not block the other publishes
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, p.Pub(ctx, "async.fast", nil, nil).Wait(ctx))
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- p.Close(context.Background())
+	}()
+	select {
+	case <-closed:
+		t.Fatal("closed before the running publish")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	require.NoError(t, <-closed)
+	f := <-slow
+	select {
+	case <-f.Done():
+		assert.NoError(t, f.Err())
+	default:
+		t.Fatal("future not resolved by Close")
+	}
+}
+
+var benchData = make([]byte, 256)
+
+func newBenchClient(b *testing.B, opts ...Option) *Client {
+	s := runServer(b, false)
+	c, err := NewClient(&Config{Address: []string{s.ClientURL()}}, append([]Option{WithLogger(zerolog.Nop())}, opts...)...)
+	require.NoError(b, err)
+	b.Cleanup(func() { _ = c.Close(context.Background()) })
+	return c
+}
+
+func BenchmarkPub(b *testing.B) {
+	c := newBenchClient(b)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.Pub(ctx, "bench", nil, benchData); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := c.Flush(ctx); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkPubFlushTimeout(b *testing.B) {
+	c := newBenchClient(b, WithFlushTimeout(time.Second))
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.Pub(ctx, "bench", nil, benchData); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPubBatch(b *testing.B) {
+	const size = 100
+	c := newBenchClient(b)
+	ctx := context.Background()
+	batch := make([]*nats.Msg, size)
+	for i := range batch {
+		batch[i] = &nats.Msg{Subject: "bench", Data: benchData}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += size {
+		n := size
+		if b.N-i < n {
+			n = b.N - i
+		}
+		if err := c.PubBatch(ctx, batch[:n]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAsyncPublisher(b *testing.B) {
+	c := newBenchClient(b)
+	p := c.NewAsyncPublisher()
+	ctx := context.Background()
+	futures := make([]*PubFuture, 0, b.N)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		futures = append(futures, p.Pub(ctx, "bench", nil, benchData))
+	}
+	if err := p.Close(ctx); err != nil {
+		b.Fatal(err)
+	}
+	for _, f := range futures {
+		if err := f.Err(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package nats
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+	"github.com/siangyeh8818/commonTools/errors"
+
+	commonTime "github.com/siangyeh8818/commonTools/time"
+)
+
+const (
+	// headerError carries the exception envelope returned by a responder
+	headerError = "error"
+	// HeaderDeadline is the unix milliseconds after which the publisher stops waiting,
+	// handlers run with a context that ends no later than it. Request sets it from ctx.
+	HeaderDeadline = "deadline"
+
+	defaultRequestTimeout = 30 * time.Second
+)
+
+// Responder 回覆 Request, Handler 回傳的 error 會以 header 傳回給請求方
+type Responder struct {
+	ChannelName string
+	GroupName   string
+	Handler     func(ctx context.Context, msg *nats.Msg) ([]byte, error)
+	Timeout     time.Duration // 未設定時使用 Config.HandlerTimeout
+}
+
+// Request 推送並等待回覆, ctx 沒有 deadline 時最多等待 30 秒
+func (c *Client) Request(ctx context.Context, subject string, header map[string][]string, data []byte) (*nats.Msg, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultRequestTimeout)
+		defer cancel()
+	}
+
+	msg := newMsg(subject, header, data)
+	deadline, _ := ctx.Deadline()
+	msg.Header.Set(HeaderDeadline, strconv.FormatInt(commonTime.MilliSecond(deadline), 10))
+
+	var reply *nats.Msg
+	err := c.publish(ctx, msg, func(ctx context.Context, msg *nats.Msg) (err error) {
+		if err := c.checkConnected(); err != nil {
+			return err
+		}
+		reply, err = c.natsConn.RequestMsgWithContext(ctx, msg)
+		switch {
+		case err == nats.ErrNoResponders:
+			return errors.Wrapf(errors.ErrResourceNotFound, "no responders for %s", subject)
+		case err == context.DeadlineExceeded || err == nats.ErrTimeout:
+			return errors.Wrapf(errors.ErrInternal, "request to %s timeout", subject)
+		case err != nil:
+			return errors.Wrapf(errors.ErrInternal, "fail to request to nats, err: %s", err.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.decompress(reply); err != nil {
+		return reply, err
+	}
+
+	if e := reply.Header.Get(headerError); e != "" {
+		return reply, errors.FromWire([]byte(e))
+	}
+	return reply, nil
+}
+
+// RegisterResponder ...
+func (c *Client) RegisterResponder(responders []Responder) error {
+	for i := range responders {
+		c.logger().Info().Msgf("Register responder: %s", responders[i].ChannelName)
+		name, group, respondHandler := responders[i].ChannelName, responders[i].GroupName, responders[i].Handler
+		channel := Channel{ChannelName: name, GroupName: group, Timeout: responders[i].Timeout}
+
+		respond := func(ctx context.Context, msg *nats.Msg) error {
+			var data []byte
+			err := errors.Recover(func() (err error) {
+				data, err = respondHandler(ctx, msg)
+				return err
+			})
+			if rErr := c.respond(ctx, msg, data, err); rErr != nil {
+				log.Ctx(ctx).Error().Msgf("channel: %s, fail to respond, err: %s", name, rErr.Error())
+			}
+			return err
+		}
+
+		handler := c.wrap(respond, nil)
+		sub, err := c.natsConn.QueueSubscribe(name, group, func(msg *nats.Msg) {
+			_ = c.process(channel, handler, msg)
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := c.addSubscription(channel, sub, nil, nil, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// respond publishes the reply of msg, a handler error is sent in the error header
+func (c *Client) respond(ctx context.Context, msg *nats.Msg, data []byte, err error) error {
+	if msg.Reply == "" {
+		return nil
+	}
+	reply := newMsg(msg.Reply, nil, data)
+	if err != nil {
+		b, wErr := errors.ToWire(errors.WithContext(ctx, err))
+		if wErr != nil {
+			return wErr
+		}
+		reply.Header.Set(headerError, string(b))
+		reply.Data = nil
+	}
+	return c.publish(ctx, reply, func(ctx context.Context, reply *nats.Msg) error {
+		return msg.RespondMsg(reply)
+	})
+}
@@ -0,0 +1,60 @@
+package nats
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siangyeh8818/commonTools/errors"
+	traceRequestID "github.com/siangyeh8818/commonTools/trace/requestID"
+)
+
+func TestRequest(t *testing.T) {
+	c := newTestClient(t)
+
+	err := c.RegisterResponder([]Responder{
+		{
+			ChannelName: "echo",
+			GroupName:   "workers",
+			Handler: func(ctx context.Context, msg *nats.Msg) ([]byte, error) {
+				return append([]byte(traceRequestID.FromContext(ctx)+":"), msg.Data...), nil
+			},
+		},
+		{
+			ChannelName: "fail",
+			Handler: func(ctx context.Context, msg *nats.Msg) ([]byte, error) {
+				return nil, errors.Wrap(errors.ErrResourceNotFound, "order A1")
+			},
+		},
+		{
+			ChannelName: "slow",
+			Handler: func(ctx context.Context, msg *nats.Msg) ([]byte, error) {
+				time.Sleep(time.Second)
+				return nil, nil
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	ctx := traceRequestID.ContextWithXRequestID(context.Background(), "req-1")
+	reply, err := c.Request(ctx, "echo", nil, []byte("hi"))
+	require.NoError(t, err)
+	assert.Equal(t, "req-1:hi", string(reply.Data))
+	assert.Equal(t, "req-1", reply.Header.Get("request_id"))
+
+	_, err = c.Request(ctx, "fail", nil, nil)
+	assert.True(t, errors.Is(err, errors.ErrResourceNotFound))
+	assert.Contains(t, err.Error(), "order A1")
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = c.Request(timeoutCtx, "slow", nil, nil)
+	assert.True(t, errors.Is(err, errors.ErrInternal))
+
+	_, err = c.Request(ctx, "nobody", nil, nil)
+	assert.True(t, errors.Is(err, errors.ErrResourceNotFound))
+}
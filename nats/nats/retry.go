@@ -0,0 +1,234 @@
+package nats
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+// dead-letter headers, set on the message republished to RetryPolicy.DeadLetterSubject
+const (
+	HeaderDLQSubject   = "dlq_subject"
+	HeaderDLQErrorCode = "dlq_error_code"
+	HeaderDLQAttempts  = "dlq_attempts"
+	HeaderDLQError     = "dlq_error"
+)
+
+const (
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 10 * time.Second
+	defaultMultiplier     = 2
+	replayIdleTimeout     = time.Second
+)
+
+// RetryPolicy 重試失敗的 Handler, 每次重試都有自己的 Channel.Timeout.
+// 最後一次仍失敗, 或錯誤不可重試時, 訊息會推送到 DeadLetterSubject (有設定時) 並視為已處理.
+type RetryPolicy struct {
+	MaxAttempts    int           // 包含第一次, 小於 1 視為 1
+	InitialBackoff time.Duration // 預設 100ms
+	MaxBackoff     time.Duration // 預設 10s
+	Multiplier     float64       // 預設 2
+	Jitter         float64       // 0 ~ 1, backoff 隨機增減的比例
+	// Retryable 預設 errors.IsRetryable, Term 包裝的錯誤一律不重試
+	Retryable         func(err error) bool
+	DeadLetterSubject string
+}
+
+// WithRetry retries the handler of Sub, see RetryPolicy
+func WithRetry(policy RetryPolicy) SubOption {
+	return func(channel *Channel) {
+		channel.Retry = &policy
+	}
+}
+
+// backoff returns how long to wait after the attempt-th failure
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	initial, max, multiplier := p.InitialBackoff, p.MaxBackoff, p.Multiplier
+	if initial <= 0 {
+		initial = defaultInitialBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+	if multiplier < 1 {
+		multiplier = defaultMultiplier
+	}
+	d := math.Min(float64(initial)*math.Pow(multiplier, float64(attempt-1)), float64(max))
+	if p.Jitter > 0 {
+		d += d * math.Min(p.Jitter, 1) * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(d)
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if isTerm(err) {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return errors.IsRetryable(err)
+}
+
+// process handles msg of channel, retrying and dead-lettering it by channel.Retry
+func (c *Client) process(channel Channel, handler Handler, msg *nats.Msg) error {
+	c.inflight.begin()
+	defer c.inflight.end()
+	handled := c.observe(channel, msg)
+	// a message that can not be decompressed never reaches the handler and is not redelivered
+	if err := c.decompress(msg); err != nil {
+		c.logger().Error().Msgf("channel: %s, drop message, err: %s", channel.ChannelName, err.Error())
+		handled(err)
+		return Term(err)
+	}
+	err := c.retry(channel, handler, msg)
+	handled(err)
+	return err
+}
+
+// retry runs handler until it succeeds or channel.Retry gives up
+func (c *Client) retry(channel Channel, handler Handler, msg *nats.Msg) error {
+	policy := channel.Retry
+	if policy == nil {
+		return c.handle(channel.ChannelName, channel.Timeout, handler, msg)
+	}
+
+	var err error
+	attempt := 0
+	for {
+		attempt++
+		if err = c.handle(channel.ChannelName, channel.Timeout, handler, msg); err == nil {
+			return nil
+		}
+		if attempt >= policy.MaxAttempts || !policy.retryable(err) {
+			break
+		}
+		select {
+		case <-time.After(policy.backoff(attempt)):
+		case <-c.baseCtx.Done():
+			return err
+		}
+	}
+
+	if policy.DeadLetterSubject == "" {
+		return err
+	}
+	if dlqErr := c.deadLetter(channel, policy.DeadLetterSubject, msg, attempt, err); dlqErr != nil {
+		c.logger().Error().Msgf("channel: %s, fail to dead-letter message, err: %s", channel.ChannelName, dlqErr.Error())
+		return err
+	}
+	c.logger().Warn().Msgf("channel: %s, message dead-lettered to %s after %d attempts", channel.ChannelName, policy.DeadLetterSubject, attempt)
+	return nil
+}
+
+// deadLetter republishes msg to subject with the dlq headers, see republish.
+// A message of a JetStream channel is only dead-lettered into a stream.
+func (c *Client) deadLetter(channel Channel, subject string, msg *nats.Msg, attempts int, err error) error {
+	header := nats.Header{}
+	for k, v := range msg.Header {
+		// the stream of subject may already store the original id and drop the dead letter as a duplicate
+		if k != HeaderMsgID {
+			header[k] = v
+		}
+	}
+	header.Set(HeaderDLQSubject, msg.Subject)
+	header.Set(HeaderDLQErrorCode, errors.Code(err))
+	header.Set(HeaderDLQAttempts, strconv.Itoa(attempts))
+	header.Set(HeaderDLQError, err.Error())
+
+	ctx, cancel := context.WithTimeout(c.baseCtx, c.flushTimeout())
+	defer cancel()
+	return c.republish(ctx, subject, header, msg.Data, channel.JetStream)
+}
+
+// republish publishes a dead-lettered or replayed message, it returns nil only once the message is safe:
+// stored by the stream of subject (JSPub, a duplicate is an error), or flushed to the server for a core subject
+// unless needStream is set
+func (c *Client) republish(ctx context.Context, subject string, header map[string][]string, data []byte, needStream bool) error {
+	if needStream && c.js == nil {
+		return errors.Wrapf(errors.ErrInternal, "jetstream is not enabled")
+	}
+	if c.js != nil {
+		streams, err := c.streamsBySubject(subject)
+		if err != nil {
+			return err
+		}
+		if len(streams) > 0 {
+			ack, err := c.JSPub(ctx, subject, header, data)
+			if err != nil {
+				return err
+			}
+			if ack.Duplicate {
+				return errors.Wrapf(errors.ErrInternal, "message to %s dropped by stream %s as a duplicate", subject, ack.Stream)
+			}
+			return nil
+		}
+		if needStream {
+			return errors.Wrapf(errors.ErrInternal, "no stream stores %s", subject)
+		}
+	}
+	if err := c.Pub(ctx, subject, header, data); err != nil {
+		return err
+	}
+	return c.Flush(ctx)
+}
+
+// ReplayDeadLetters 將 JetStream 中 subject 的 dead-letter 訊息推送回原本的 subject, 最多 limit 筆 (0 為全部),
+// 回傳推送的筆數. 原本的 subject 存在 stream 時等待 PubAck, 每筆推送後會 Ack, DLQ stream 使用 workqueue retention 時 Ack 後即從 stream 移除.
+func (c *Client) ReplayDeadLetters(ctx context.Context, subject string, limit int) (int, error) {
+	if c.js == nil {
+		return 0, errors.Wrapf(errors.ErrInternal, "jetstream is not enabled")
+	}
+	sub, err := c.js.SubscribeSync(subject, nats.AckExplicit(), nats.DeliverAll())
+	if err != nil {
+		return 0, errors.Wrapf(errors.ErrInternal, "fail to subscribe to %s, err: %s", subject, err.Error())
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+
+	replayed := 0
+	for limit <= 0 || replayed < limit {
+		idleCtx, cancel := context.WithTimeout(ctx, replayIdleTimeout)
+		msg, err := sub.NextMsgWithContext(idleCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return replayed, errors.Wrapf(errors.ErrInternal, "replay %s interrupted, err: %s", subject, ctx.Err().Error())
+			}
+			// nothing left to replay
+			return replayed, nil
+		}
+
+		original := msg.Header.Get(HeaderDLQSubject)
+		if original == "" {
+			c.logger().Warn().Msgf("dead letter on %s has no %s header, skipped", msg.Subject, HeaderDLQSubject)
+			_ = msg.Term()
+			continue
+		}
+		// Nats-Msg-Id is dropped too, the stream of the original subject already stored it
+		header := nats.Header{}
+		for k, v := range msg.Header {
+			if !strings.HasPrefix(k, "dlq_") && !strings.HasPrefix(k, "Nats-") {
+				header[k] = v
+			}
+		}
+		if err := c.republish(ctx, original, header, msg.Data, false); err != nil {
+			_ = msg.Nak()
+			return replayed, err
+		}
+		if err := msg.AckSync(nats.Context(ctx)); err != nil {
+			return replayed, errors.Wrapf(errors.ErrInternal, "fail to ack dead letter, err: %s", err.Error())
+		}
+		replayed++
+
+		if meta, err := msg.Metadata(); err == nil && meta.NumPending == 0 {
+			return replayed, nil
+		}
+	}
+	return replayed, nil
+}
@@ -0,0 +1,236 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	assert.Equal(t, 10*time.Millisecond, p.backoff(1))
+	assert.Equal(t, 20*time.Millisecond, p.backoff(2))
+	assert.Equal(t, 50*time.Millisecond, p.backoff(5))
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.backoff(2)
+		assert.True(t, d >= 10*time.Millisecond && d <= 30*time.Millisecond, d)
+	}
+}
+
+func TestRetrySucceeds(t *testing.T) {
+	c := newTestClient(t)
+
+	var calls int32
+	done := make(chan struct{})
+	_, err := c.Sub("retry.ok", func(ctx context.Context, msg *nats.Msg) error {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			return fmt.Errorf("temporary")
+		}
+		close(done)
+		return nil
+	}, WithRetry(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}))
+	require.NoError(t, err)
+
+	require.NoError(t, c.Pub(context.Background(), "retry.ok", nil, nil))
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler not retried")
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestRetryDeadLetter(t *testing.T) {
+	c := newTestClient(t)
+
+	dead := make(chan *nats.Msg, 2)
+	_, err := c.Sub("retry.dlq", func(ctx context.Context, msg *nats.Msg) error {
+		dead <- msg
+		return nil
+	})
+	require.NoError(t, err)
+
+	var calls int32
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, DeadLetterSubject: "retry.dlq"}
+	_, err = c.Sub("retry.fail", func(ctx context.Context, msg *nats.Msg) error {
+		atomic.AddInt32(&calls, 1)
+		if string(msg.Data) == "bad" {
+			return errors.Wrapf(errors.ErrInvalidInput, "bad payload")
+		}
+		return errors.Wrapf(errors.ErrInternal, "db is down")
+	}, WithRetry(policy))
+	require.NoError(t, err)
+
+	require.NoError(t, c.Pub(context.Background(), "retry.fail", map[string][]string{"order_id": {"1"}}, []byte("ok")))
+	select {
+	case msg := <-dead:
+		assert.Equal(t, "retry.fail", msg.Header.Get(HeaderDLQSubject))
+		assert.Equal(t, errors.ErrInternal.Code, msg.Header.Get(HeaderDLQErrorCode))
+		assert.Equal(t, "3", msg.Header.Get(HeaderDLQAttempts))
+		assert.Contains(t, msg.Header.Get(HeaderDLQError), "db is down")
+		assert.Equal(t, "1", msg.Header.Get("order_id"))
+		assert.Equal(t, "ok", string(msg.Data))
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not dead-lettered")
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// not retryable, dead-lettered after the first attempt
+	require.NoError(t, c.Pub(context.Background(), "retry.fail", nil, []byte("bad")))
+	select {
+	case msg := <-dead:
+		assert.Equal(t, "1", msg.Header.Get(HeaderDLQAttempts))
+		assert.Equal(t, errors.ErrInvalidInput.Code, msg.Header.Get(HeaderDLQErrorCode))
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not dead-lettered")
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	c := newJetStreamClient(t)
+
+	var fail int32 = 1
+	handled := make(chan string, 3)
+	_, err := c.Sub("replay.orders", func(ctx context.Context, msg *nats.Msg) error {
+		if atomic.LoadInt32(&fail) == 1 {
+			return Term(errors.Wrapf(errors.ErrInternal, "downstream is down"))
+		}
+		handled <- string(msg.Data)
+		return nil
+	}, WithRetry(RetryPolicy{MaxAttempts: 2, DeadLetterSubject: "dlq.orders"}))
+	require.NoError(t, err)
+
+	for _, id := range []string{"1", "2", "3"} {
+		require.NoError(t, c.Pub(context.Background(), "replay.orders", nil, []byte(id)))
+	}
+	require.Eventually(t, func() bool {
+		info, err := c.js.StreamInfo("DLQ")
+		return err == nil && info.State.Msgs == 3
+	}, 2*time.Second, 10*time.Millisecond)
+
+	atomic.StoreInt32(&fail, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n, err := c.ReplayDeadLetters(ctx, "dlq.orders", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		select {
+		case data := <-handled:
+			got = append(got, data)
+		case <-time.After(2 * time.Second):
+			t.Fatal("replayed message not handled")
+		}
+	}
+	assert.ElementsMatch(t, []string{"1", "2", "3"}, got)
+
+	info, err := c.js.StreamInfo("DLQ")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), info.State.Msgs)
+}
+
+func TestJetStreamDeadLetter(t *testing.T) {
+	c := newJetStreamClient(t)
+
+	var stored, lost int32
+	policy := func(subject string) *RetryPolicy {
+		return &RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, DeadLetterSubject: subject}
+	}
+	_, err := c.RegisterChannel([]Channel{{
+		ChannelName: "orders.dlq.stored",
+		JetStream:   true,
+		Retry:       policy("dlq.orders.stored"),
+		Handler: func(ctx context.Context, msg *nats.Msg) error {
+			atomic.AddInt32(&stored, 1)
+			return errors.ErrInternal
+		},
+	}, {
+		// no stream stores the dead-letter subject, the message must stay in ORDERS
+		ChannelName: "orders.dlq.lost",
+		JetStream:   true,
+		Retry:       policy("nostream.dlq"),
+		Handler: func(ctx context.Context, msg *nats.Msg) error {
+			atomic.AddInt32(&lost, 1)
+			return errors.ErrInternal
+		},
+	}})
+	require.NoError(t, err)
+
+	for _, subject := range []string{"orders.dlq.stored", "orders.dlq.lost"} {
+		_, err := c.JSPub(context.Background(), subject, nil, []byte("1"))
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		info, err := c.js.StreamInfo("DLQ")
+		return err == nil && info.State.Msgs == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&lost) > 2 }, 5*time.Second, 10*time.Millisecond, "message redelivered after the failed dead-letter")
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&stored))
+}
+
+func TestJetStreamDeadLetterSameStream(t *testing.T) {
+	c := newJetStreamClient(t)
+
+	_, err := c.RegisterChannel([]Channel{{
+		ChannelName: "orders.x",
+		JetStream:   true,
+		Retry:       &RetryPolicy{MaxAttempts: 1, DeadLetterSubject: "orders.dead"},
+		Handler: func(ctx context.Context, msg *nats.Msg) error {
+			return errors.ErrInternal
+		},
+	}})
+	require.NoError(t, err)
+
+	// the dead letter keeps the data and headers of the original but not its Nats-Msg-Id
+	_, err = c.JSPub(context.Background(), "orders.x", map[string][]string{HeaderMsgID: {"order-1"}}, []byte("1"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		info, err := c.js.StreamInfo("ORDERS")
+		return err == nil && info.State.Msgs == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		ci, err := c.js.ConsumerInfo("ORDERS", "test_orders_x")
+		return err == nil && ci.NumAckPending == 0 && ci.AckFloor.Consumer == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	dead, err := c.js.GetMsg("ORDERS", 2)
+	require.NoError(t, err)
+	assert.Equal(t, "orders.dead", dead.Subject)
+	assert.Equal(t, "orders.x", dead.Header.Get(HeaderDLQSubject))
+	assert.NotEqual(t, "order-1", dead.Header.Get(HeaderMsgID))
+}
+
+func TestReplayDeadLettersIntoStream(t *testing.T) {
+	c := newJetStreamClient(t)
+
+	_, err := c.JSPub(context.Background(), "orders.replayed", map[string][]string{HeaderMsgID: {"order-2"}}, []byte("1"))
+	require.NoError(t, err)
+	header := map[string][]string{HeaderMsgID: {"order-2"}, HeaderDLQSubject: {"orders.replayed"}}
+	_, err = c.JSPub(context.Background(), "dlq.replayed", header, []byte("1"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n, err := c.ReplayDeadLetters(ctx, "dlq.replayed", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	info, err := c.js.StreamInfo("ORDERS")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), info.State.Msgs, "the replayed message is not dropped as a duplicate")
+}
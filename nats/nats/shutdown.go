@@ -0,0 +1,186 @@
+package nats
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+// ShutdownReport counts the handlers Shutdown waited for
+type ShutdownReport struct {
+	Finished  int // 關閉期間處理完成的訊息, 包含 drain 時才送達的訊息
+	Abandoned int // Shutdown 回傳時仍在執行的 Handler
+}
+
+// inflight tracks the running handlers
+type inflight struct {
+	mu       sync.Mutex
+	running  int
+	finished int
+	idle     chan struct{}
+}
+
+func (f *inflight) begin() {
+	f.mu.Lock()
+	f.running++
+	f.mu.Unlock()
+}
+
+func (f *inflight) end() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.running--
+	f.finished++
+	if f.running == 0 && f.idle != nil {
+		close(f.idle)
+		f.idle = nil
+	}
+}
+
+// counts returns the running handlers and the handlers finished so far
+func (f *inflight) counts() (running, finished int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.running, f.finished
+}
+
+// wait is closed when no handler is running
+func (f *inflight) wait() <-chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.running == 0 {
+		ch := make(chan struct{})
+		close(ch)
+		return ch
+	}
+	if f.idle == nil {
+		f.idle = make(chan struct{})
+	}
+	return f.idle
+}
+
+// drain stops the subscriptions before the connection: nats closes a draining connection as soon as the
+// subscription callbacks returned, while the worker pools and the handlers still have to ack and publish.
+// It runs once in the background: drain the subscriptions, wait for the pull fetch loops, the worker pools
+// and the running handlers, delete the consumers created by the subscriptions, then drain the connection.
+// Closing the connection stops the waits.
+func (c *Client) drain() {
+	c.drainOnce.Do(func() {
+		go c.drainSubscriptions()
+	})
+}
+
+func (c *Client) drainSubscriptions() {
+	subs := c.Subscriptions()
+	for _, s := range subs {
+		if err := s.sub.Drain(); err != nil && err != nats.ErrConnectionClosed && err != nats.ErrBadSubscription {
+			c.logger().Error().Msgf("fail to drain %s, err: %s", s.Channel.ChannelName, err.Error())
+		}
+	}
+	for _, s := range subs {
+		if !s.waitDrained(c.closed) {
+			return
+		}
+	}
+
+	fetched := make(chan struct{})
+	go func() {
+		c.fetchers.Wait()
+		close(fetched)
+	}()
+	select {
+	case <-fetched:
+	case <-c.closed:
+		return
+	}
+	c.stopPools()
+	select {
+	case <-c.inflight.wait():
+	case <-c.closed:
+		return
+	}
+	for _, s := range subs {
+		c.deleteConsumer(s.consumer)
+	}
+
+	err := c.natsConn.Drain()
+	if err != nil && err != nats.ErrConnectionClosed && err != nats.ErrConnectionDraining {
+		c.logger().Error().Msgf("fail to drain nats connection, close it, err: %s", err.Error())
+		c.natsConn.Close()
+	}
+}
+
+// Shutdown 停止接收新訊息 (drain), 等待處理中的 Handler.
+// 超過 Config.ShutdownGrace 時取消 Handler 的 context 並繼續等到 ctx 結束, ctx 結束時直接關閉連線,
+// 仍在執行的 Handler 記為 Abandoned.
+func (c *Client) Shutdown(ctx context.Context) (ShutdownReport, error) {
+	_, start := c.inflight.counts()
+	c.drain()
+
+	// the connection is closed once drained, no handler starts after that
+	stopped := make(chan struct{})
+	go func() {
+		<-c.done
+		<-c.inflight.wait()
+		close(stopped)
+	}()
+
+	grace := time.NewTimer(c.cfg.ShutdownGrace)
+	defer grace.Stop()
+	select {
+	case <-stopped:
+	case <-grace.C:
+		c.logger().Warn().Msgf("shutdown grace period %s is over, cancel the running handlers", c.cfg.ShutdownGrace)
+		c.baseCancel()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+		}
+	case <-ctx.Done():
+	}
+
+	if ctx.Err() != nil {
+		c.natsConn.Close()
+		c.baseCancel()
+	}
+	running, finished := c.inflight.counts()
+	report := ShutdownReport{Finished: finished - start, Abandoned: running}
+	if ctx.Err() != nil {
+		return report, errors.Wrapf(errors.ErrInternal, "shutdown interrupted with %d handlers running, err: %s", running, ctx.Err().Error())
+	}
+	return report, nil
+}
+
+// ShutdownOnSignal 收到 signals (預設 SIGINT 與 SIGTERM) 時呼叫 Shutdown, 最多等待 timeout.
+// 回傳的 channel 會收到 Shutdown 的 error.
+func (c *Client) ShutdownOnSignal(timeout time.Duration, signals ...os.Signal) <-chan error {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, signals...)
+
+	errCh := make(chan error, 1)
+	go func() {
+		defer signal.Stop(sigCh)
+		select {
+		case sig := <-sigCh:
+			c.logger().Info().Msgf("receive signal %s, shutdown nats client", sig)
+		case <-c.done:
+			errCh <- nil
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		report, err := c.Shutdown(ctx)
+		c.logger().Info().Msgf("nats client shutdown, %d handlers finished, %d abandoned", report.Finished, report.Abandoned)
+		errCh <- err
+	}()
+	return errCh
+}
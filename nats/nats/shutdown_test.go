@@ -0,0 +1,105 @@
+package nats
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+func newShutdownClient(t *testing.T, grace time.Duration) *Client {
+	s := runServer(t, false)
+	c, err := NewClient(&Config{Name: "test", Address: []string{s.ClientURL()}, ShutdownGrace: grace})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close(context.Background()) })
+	return c
+}
+
+func TestShutdownWaitsForHandlers(t *testing.T) {
+	c := newShutdownClient(t, time.Second)
+
+	started := make(chan struct{}, 3)
+	_, err := c.Sub("shutdown", func(ctx context.Context, msg *nats.Msg) error {
+		started <- struct{}{}
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	}, WithWorkers(3, 3))
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, c.Pub(context.Background(), "shutdown", nil, nil))
+	}
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	report, err := c.Shutdown(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, ShutdownReport{Finished: 3}, report)
+}
+
+func TestShutdownGraceCancelsHandlers(t *testing.T) {
+	c := newShutdownClient(t, 50*time.Millisecond)
+
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	_, err := c.Sub("shutdown", func(ctx context.Context, msg *nats.Msg) error {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		return ctx.Err()
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.Pub(context.Background(), "shutdown", nil, nil))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	report, err := c.Shutdown(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, ShutdownReport{Finished: 1}, report)
+	<-cancelled
+}
+
+func TestShutdownAbandonsHandlers(t *testing.T) {
+	c := newShutdownClient(t, 10*time.Millisecond)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	_, err := c.Sub("shutdown", func(ctx context.Context, msg *nats.Msg) error {
+		close(started)
+		<-release
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, c.Pub(context.Background(), "shutdown", nil, nil))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	report, err := c.Shutdown(ctx)
+	assert.True(t, errors.Is(err, errors.ErrInternal))
+	assert.Equal(t, ShutdownReport{Abandoned: 1}, report)
+}
+
+func TestShutdownOnSignal(t *testing.T) {
+	c := newShutdownClient(t, time.Second)
+
+	errCh := c.ShutdownOnSignal(time.Second, syscall.SIGUSR1)
+	require.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGUSR1))
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("client not shutdown")
+	}
+	assert.True(t, c.natsConn.IsClosed())
+}
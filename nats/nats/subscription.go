@@ -0,0 +1,147 @@
+package nats
+
+import (
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+// drainPollInterval is how often a drained subscription is checked, nats.go does not report when it is done
+const drainPollInterval = 10 * time.Millisecond
+
+// Subscription 是 Sub, RegisterChannel 與 RegisterResponder 建立的訂閱, 在 Unsubscribe 前都會留在 Client.Subscriptions
+type Subscription struct {
+	Channel Channel
+
+	client   *Client
+	sub      *nats.Subscription
+	pool     *workerPool
+	consumer *jsConsumer // JetStream channels only
+}
+
+// Subject returns the subject the subscription listens on
+func (s *Subscription) Subject() string {
+	return s.sub.Subject
+}
+
+// IsValid reports whether the subscription is still active
+func (s *Subscription) IsValid() bool {
+	return s.sub.IsValid()
+}
+
+// Unsubscribe 停止訂閱, 等待 worker pool 中已收到的訊息處理完.
+// JetStream channel 由訂閱建立的 consumer 會一併刪除
+func (s *Subscription) Unsubscribe() error {
+	s.client.removeSubscription(s)
+	err := s.sub.Unsubscribe()
+	if s.pool != nil {
+		s.pool.stop()
+	}
+	s.client.deleteConsumer(s.consumer)
+	if err != nil && err != nats.ErrConnectionClosed && err != nats.ErrBadSubscription {
+		return errors.Wrapf(errors.ErrInternal, "fail to unsubscribe %s, err: %s", s.Channel.ChannelName, err.Error())
+	}
+	return nil
+}
+
+// Drain 停止接收新訊息, 已收到的訊息在背景處理完後才取消訂閱並停止 worker pool.
+// JetStream channel 由訂閱建立的 consumer 在訊息都 Ack 後刪除
+func (s *Subscription) Drain() error {
+	s.client.removeSubscription(s)
+	if err := s.sub.Drain(); err != nil && err != nats.ErrConnectionClosed && err != nats.ErrBadSubscription {
+		return errors.Wrapf(errors.ErrInternal, "fail to drain %s, err: %s", s.Channel.ChannelName, err.Error())
+	}
+	go func() {
+		drained := s.waitDrained(s.client.closed)
+		if s.pool != nil {
+			s.pool.stop()
+		}
+		if drained {
+			s.client.deleteConsumer(s.consumer)
+		}
+	}()
+	return nil
+}
+
+// waitDrained waits until the drained subscription delivered its last message, it returns false once closed is closed
+func (s *Subscription) waitDrained(closed <-chan struct{}) bool {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for s.sub.IsValid() {
+		select {
+		case <-ticker.C:
+		case <-closed:
+			return false
+		}
+	}
+	return true
+}
+
+// Pending returns the messages and bytes received but not yet handed to the handler
+func (s *Subscription) Pending() (msgs int, bytes int, err error) {
+	msgs, bytes, err = s.sub.Pending()
+	if err != nil {
+		return 0, 0, errors.Wrapf(errors.ErrInternal, "fail to get pending of %s, err: %s", s.Channel.ChannelName, err.Error())
+	}
+	return msgs, bytes, nil
+}
+
+// Delivered returns the number of messages handed to the handler
+func (s *Subscription) Delivered() (int64, error) {
+	n, err := s.sub.Delivered()
+	if err != nil {
+		return 0, errors.Wrapf(errors.ErrInternal, "fail to get delivered of %s, err: %s", s.Channel.ChannelName, err.Error())
+	}
+	return n, nil
+}
+
+// Dropped returns the number of messages dropped because the pending limits were reached
+func (s *Subscription) Dropped() (int, error) {
+	n, err := s.sub.Dropped()
+	if err != nil {
+		return 0, errors.Wrapf(errors.ErrInternal, "fail to get dropped of %s, err: %s", s.Channel.ChannelName, err.Error())
+	}
+	return n, nil
+}
+
+// SetPendingLimits replaces Config.PendingMsgsLimit and PendingBytesLimit for this subscription
+func (s *Subscription) SetPendingLimits(msgs, bytes int) error {
+	if err := s.sub.SetPendingLimits(msgs, bytes); err != nil {
+		return errors.Wrapf(errors.ErrInvalidInput, "fail to set pending limits of %s, err: %s", s.Channel.ChannelName, err.Error())
+	}
+	return nil
+}
+
+// Subscriptions returns the active subscriptions in the order they were created
+func (c *Client) Subscriptions() []*Subscription {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+	return append([]*Subscription(nil), c.subs...)
+}
+
+// addSubscription applies the pending limits to sub and keeps it in the registry
+func (c *Client) addSubscription(channel Channel, sub *nats.Subscription, pool *workerPool, consumer *jsConsumer, limits bool) (*Subscription, error) {
+	if limits {
+		if err := c.setPendingLimits(sub); err != nil {
+			_ = sub.Unsubscribe()
+			return nil, err
+		}
+	}
+	s := &Subscription{Channel: channel, client: c, sub: sub, pool: pool, consumer: consumer}
+	c.subsMu.Lock()
+	c.subs = append(c.subs, s)
+	c.subsMu.Unlock()
+	return s, nil
+}
+
+func (c *Client) removeSubscription(s *Subscription) {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+	for i := range c.subs {
+		if c.subs[i] == s {
+			c.subs = append(c.subs[:i], c.subs[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package nats
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscriptionHandles(t *testing.T) {
+	c := newTestClient(t)
+
+	got := make(chan string, 10)
+	handler := func(ctx context.Context, msg *nats.Msg) error {
+		got <- msg.Subject
+		return nil
+	}
+	a, err := c.Sub("subs.a", handler)
+	require.NoError(t, err)
+	subs, err := c.RegisterChannel([]Channel{
+		{ChannelName: "subs.b", GroupName: "group", Handler: handler},
+		{ChannelName: "subs.c", Handler: handler, Workers: 2},
+	})
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	require.NoError(t, c.RegisterResponder([]Responder{{ChannelName: "subs.d", Handler: func(ctx context.Context, msg *nats.Msg) ([]byte, error) {
+		return nil, nil
+	}}}))
+
+	var subjects []string
+	for _, s := range c.Subscriptions() {
+		subjects = append(subjects, s.Subject())
+	}
+	assert.Equal(t, []string{"subs.a", "subs.b", "subs.c", "subs.d"}, subjects)
+
+	for _, subject := range []string{"subs.a", "subs.b", "subs.c"} {
+		require.NoError(t, c.Pub(context.Background(), subject, nil, nil))
+		select {
+		case s := <-got:
+			assert.Equal(t, subject, s)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s not handled", subject)
+		}
+	}
+	delivered, err := a.Delivered()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), delivered)
+	dropped, err := a.Dropped()
+	require.NoError(t, err)
+	assert.Equal(t, 0, dropped)
+	msgs, _, err := a.Pending()
+	require.NoError(t, err)
+	assert.Equal(t, 0, msgs)
+	require.NoError(t, a.SetPendingLimits(10, 1024))
+
+	require.NoError(t, a.Unsubscribe())
+	require.NoError(t, subs[1].Unsubscribe())
+	require.NoError(t, subs[0].Drain())
+	assert.False(t, a.IsValid())
+	require.Len(t, c.Subscriptions(), 1)
+	assert.Equal(t, "subs.d", c.Subscriptions()[0].Subject())
+
+	require.NoError(t, c.Pub(context.Background(), "subs.a", nil, nil))
+	require.NoError(t, c.Pub(context.Background(), "subs.c", nil, nil))
+	select {
+	case s := <-got:
+		t.Fatalf("%s handled after unsubscribe", s)
+	case <-time.After(100 * time.Millisecond):
+	}
+	_, err = a.Delivered()
+	assert.Error(t, err)
+}
+
+func TestSubscriptionDrainStopsPool(t *testing.T) {
+	c := newTestClient(t)
+
+	var handled int32
+	s, err := c.Sub("subs.drain", func(ctx context.Context, msg *nats.Msg) error {
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&handled, 1)
+		return nil
+	}, WithWorkers(2, 10))
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, c.Pub(context.Background(), "subs.drain", nil, nil))
+	}
+	require.NoError(t, c.natsConn.Flush())
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, s.Drain())
+
+	stopped := make(chan struct{})
+	go func() {
+		s.pool.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("worker pool not stopped after drain")
+	}
+	assert.Equal(t, int32(10), atomic.LoadInt32(&handled))
+	assert.False(t, s.IsValid())
+}
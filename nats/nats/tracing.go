@@ -0,0 +1,384 @@
+package nats
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/siangyeh8818/commonTools/errors"
+)
+
+// W3C trace context headers, https://www.w3.org/TR/trace-context/ and https://www.w3.org/TR/baggage/
+const (
+	HeaderTraceparent = "traceparent"
+	HeaderTracestate  = "tracestate"
+	HeaderBaggage     = "baggage"
+)
+
+// SpanKind of the spans created by the client
+const (
+	SpanKindProducer = "producer"
+	SpanKindConsumer = "consumer"
+)
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+// String returns the lowercase hex of the id
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+// String returns the lowercase hex of the id
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// SpanContext is the part of a span propagated to other services
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Sampled    bool
+	TraceState string
+}
+
+// IsValid reports whether both ids are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats sc as a version 00 traceparent header
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses a traceparent header, future versions are read as version 00
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, errors.Wrapf(errors.ErrInvalidInput, "invalid traceparent %q", s)
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil || len(parts[1]) != 32 {
+		return sc, errors.Wrapf(errors.ErrInvalidInput, "invalid trace id in traceparent %q", s)
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil || len(parts[2]) != 16 {
+		return sc, errors.Wrapf(errors.ErrInvalidInput, "invalid span id in traceparent %q", s)
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, errors.Wrapf(errors.ErrInvalidInput, "invalid flags in traceparent %q", s)
+	}
+	if !sc.IsValid() {
+		return sc, errors.Wrapf(errors.ErrInvalidInput, "all zero id in traceparent %q", s)
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// Baggage is the W3C baggage propagated with the trace context
+type Baggage map[string]string
+
+// ParseBaggage parses a baggage header, properties after ';' are dropped
+func ParseBaggage(s string) Baggage {
+	b := Baggage{}
+	for _, member := range strings.Split(s, ",") {
+		member = strings.TrimSpace(strings.SplitN(member, ";", 2)[0])
+		kv := strings.SplitN(member, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			continue
+		}
+		v, err := url.PathUnescape(strings.TrimSpace(kv[1]))
+		if err != nil {
+			continue
+		}
+		b[strings.TrimSpace(kv[0])] = v
+	}
+	return b
+}
+
+// String formats b as a baggage header
+func (b Baggage) String() string {
+	members := make([]string, 0, len(b))
+	for k, v := range b {
+		members = append(members, k+"="+url.PathEscape(v))
+	}
+	return strings.Join(members, ",")
+}
+
+type spanContextKey struct{}
+type baggageKey struct{}
+type exporterKey struct{}
+type propagatorKey struct{}
+
+// ContextWithSpanContext returns ctx carrying sc, the spans started from ctx are its children
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context of ctx, handlers get the consumer span.
+// It falls back to the OpenTelemetry span of ctx, so a publish inside an OpenTelemetry span continues its trace.
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	if sc, ok := ctx.Value(spanContextKey{}).(SpanContext); ok && sc.IsValid() {
+		return sc, true
+	}
+	sc := fromOTel(trace.SpanContextFromContext(ctx))
+	return sc, sc.IsValid()
+}
+
+// toOTel converts sc to an OpenTelemetry span context, an invalid tracestate is dropped
+func toOTel(sc SpanContext) trace.SpanContext {
+	conf := trace.SpanContextConfig{TraceID: trace.TraceID(sc.TraceID), SpanID: trace.SpanID(sc.SpanID)}
+	if sc.Sampled {
+		conf.TraceFlags = trace.FlagsSampled
+	}
+	if ts, err := trace.ParseTraceState(sc.TraceState); err == nil {
+		conf.TraceState = ts
+	}
+	return trace.NewSpanContext(conf)
+}
+
+func fromOTel(sc trace.SpanContext) SpanContext {
+	return SpanContext{
+		TraceID:    TraceID(sc.TraceID()),
+		SpanID:     SpanID(sc.SpanID()),
+		Sampled:    sc.IsSampled(),
+		TraceState: sc.TraceState().String(),
+	}
+}
+
+// HeaderCarrier adapts nats.Header to the OpenTelemetry propagation.TextMapCarrier
+type HeaderCarrier nats.Header
+
+// Get returns the first value of key
+func (h HeaderCarrier) Get(key string) string {
+	return nats.Header(h).Get(key)
+}
+
+// Set replaces the values of key
+func (h HeaderCarrier) Set(key, value string) {
+	nats.Header(h).Set(key, value)
+}
+
+// Keys lists the keys of the header
+func (h HeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// ContextWithBaggage returns ctx carrying b, Pub sends it in the baggage header
+func ContextWithBaggage(ctx context.Context, b Baggage) context.Context {
+	return context.WithValue(ctx, baggageKey{}, b)
+}
+
+// BaggageFromContext returns the baggage of ctx
+func BaggageFromContext(ctx context.Context) Baggage {
+	b, _ := ctx.Value(baggageKey{}).(Baggage)
+	return b
+}
+
+// Span is a finished producer or consumer span
+type Span struct {
+	Name        string
+	Kind        string
+	SpanContext SpanContext
+	Parent      SpanContext   // invalid for a root span
+	Links       []SpanContext // the consumer span links the producer span
+	Start       time.Time
+	End         time.Time
+	Attributes  map[string]string
+	Err         error
+}
+
+// SpanExporter receives the finished spans, set it with Client.SetSpanExporter
+type SpanExporter interface {
+	ExportSpan(span Span)
+}
+
+// InMemoryExporter keeps the exported spans in memory, for tests
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+// NewInMemoryExporter ...
+func NewInMemoryExporter() *InMemoryExporter {
+	return &InMemoryExporter{}
+}
+
+// ExportSpan implement SpanExporter
+func (e *InMemoryExporter) ExportSpan(span Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+// Spans returns the exported spans in the order they ended
+func (e *InMemoryExporter) Spans() []Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Span(nil), e.spans...)
+}
+
+// Reset drops the exported spans
+func (e *InMemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
+
+// SetSpanExporter exports the producer and consumer spans of the client to e, nil stops exporting
+func (c *Client) SetSpanExporter(e SpanExporter) {
+	c.exporter.Store(exporterBox{e})
+}
+
+// exporterBox keeps the SpanExporter in an atomic.Value, which needs one concrete type
+type exporterBox struct {
+	SpanExporter
+}
+
+// SetPropagator injects and extracts the trace context headers with p, nil restores the W3C trace context.
+// Pass otel.GetTextMapPropagator() to propagate like the rest of an OpenTelemetry instrumented service.
+func (c *Client) SetPropagator(p propagation.TextMapPropagator) {
+	c.propagator.Store(propagatorBox{p})
+}
+
+// propagatorBox keeps the TextMapPropagator in an atomic.Value, which needs one concrete type
+type propagatorBox struct {
+	propagation.TextMapPropagator
+}
+
+// withTracing puts the span exporter and the propagator of the client into ctx for the trace context
+// interceptor and middleware
+func (c *Client) withTracing(ctx context.Context) context.Context {
+	if box, ok := c.exporter.Load().(exporterBox); ok && box.SpanExporter != nil {
+		ctx = context.WithValue(ctx, exporterKey{}, box.SpanExporter)
+	}
+	if box, ok := c.propagator.Load().(propagatorBox); ok && box.TextMapPropagator != nil {
+		ctx = context.WithValue(ctx, propagatorKey{}, box.TextMapPropagator)
+	}
+	return ctx
+}
+
+func propagatorFromContext(ctx context.Context) propagation.TextMapPropagator {
+	if p, ok := ctx.Value(propagatorKey{}).(propagation.TextMapPropagator); ok {
+		return p
+	}
+	return propagation.TraceContext{}
+}
+
+func exportSpan(ctx context.Context, span Span) {
+	if e, ok := ctx.Value(exporterKey{}).(SpanExporter); ok {
+		e.ExportSpan(span)
+	}
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	_, _ = rand.Read(id[:])
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	_, _ = rand.Read(id[:])
+	return id
+}
+
+// InjectTraceContext starts a producer span, child of the span of ctx or a new trace, and injects it
+// into the headers with the propagator of the client, the traceparent and tracestate headers by default.
+// The baggage of ctx is sent in the baggage header. Place it after StampTrace so the span records the request_id.
+func InjectTraceContext() Interceptor {
+	return func(next Publisher) Publisher {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			parent, _ := SpanContextFromContext(ctx)
+			span := Span{
+				Name:        msg.Subject + " send",
+				Kind:        SpanKindProducer,
+				SpanContext: SpanContext{TraceID: parent.TraceID, SpanID: newSpanID(), Sampled: true, TraceState: parent.TraceState},
+				Parent:      parent,
+				Start:       time.Now(),
+				Attributes:  map[string]string{"messaging.system": "nats", "messaging.destination": msg.Subject},
+			}
+			if parent.IsValid() {
+				span.SpanContext.Sampled = parent.Sampled
+			} else {
+				span.SpanContext.TraceID = newTraceID()
+			}
+			if requestID := msg.Header.Get("request_id"); requestID != "" {
+				span.Attributes["request_id"] = requestID
+			}
+
+			propagatorFromContext(ctx).Inject(trace.ContextWithSpanContext(ctx, toOTel(span.SpanContext)), HeaderCarrier(msg.Header))
+			if b := BaggageFromContext(ctx); len(b) > 0 {
+				// keep the OpenTelemetry baggage the propagator may have injected
+				if v := msg.Header.Get(HeaderBaggage); v != "" {
+					msg.Header.Set(HeaderBaggage, v+","+b.String())
+				} else {
+					msg.Header.Set(HeaderBaggage, b.String())
+				}
+			}
+
+			span.Err = next(ContextWithSpanContext(ctx, span.SpanContext), msg)
+			span.End = time.Now()
+			if span.SpanContext.Sampled {
+				exportSpan(ctx, span)
+			}
+			return span.Err
+		}
+	}
+}
+
+// ExtractTraceContext extracts the producer span with the propagator of the client, starts a consumer span
+// in its trace, child of and linked to it, and puts the consumer span and the baggage into the context.
+// Handlers also see the consumer span as the OpenTelemetry span context of ctx.
+func ExtractTraceContext() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg *nats.Msg) error {
+			ctx = propagatorFromContext(ctx).Extract(ctx, HeaderCarrier(msg.Header))
+			producer := fromOTel(trace.SpanContextFromContext(ctx))
+			span := Span{
+				Name:        EndpointFromContext(ctx) + " process",
+				Kind:        SpanKindConsumer,
+				SpanContext: SpanContext{TraceID: newTraceID(), SpanID: newSpanID(), Sampled: true},
+				Start:       time.Now(),
+				Attributes:  map[string]string{"messaging.system": "nats", "messaging.destination": msg.Subject},
+			}
+			if producer.IsValid() {
+				span.SpanContext.TraceID = producer.TraceID
+				span.SpanContext.Sampled = producer.Sampled
+				span.SpanContext.TraceState = producer.TraceState
+				span.Parent = producer
+				span.Links = []SpanContext{producer}
+			}
+			if requestID := msg.Header.Get("request_id"); requestID != "" {
+				span.Attributes["request_id"] = requestID
+			}
+
+			ctx = ContextWithSpanContext(trace.ContextWithSpanContext(ctx, toOTel(span.SpanContext)), span.SpanContext)
+			if b := msg.Header.Get(HeaderBaggage); b != "" {
+				ctx = ContextWithBaggage(ctx, ParseBaggage(b))
+			}
+			span.Err = next(ctx, msg)
+			span.End = time.Now()
+			if span.SpanContext.Sampled {
+				exportSpan(ctx, span)
+			}
+			return span.Err
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package nats
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/siangyeh8818/commonTools/errors"
+	traceRequestID "github.com/siangyeh8818/commonTools/trace/requestID"
+)
+
+func TestTraceparent(t *testing.T) {
+	const header = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(header)
+	require.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, header, sc.Traceparent())
+
+	_, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future")
+	assert.NoError(t, err)
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		_, err := ParseTraceparent(invalid)
+		assert.True(t, errors.Is(err, errors.ErrInvalidInput), invalid)
+	}
+}
+
+func TestBaggage(t *testing.T) {
+	b := ParseBaggage("userId=alice, serverNode = DF%2028 ;prop, invalid")
+	assert.Equal(t, Baggage{"userId": "alice", "serverNode": "DF 28"}, b)
+	assert.Equal(t, b, ParseBaggage(b.String()))
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	c := newTestClient(t)
+	exporter := NewInMemoryExporter()
+	c.SetSpanExporter(exporter)
+
+	type received struct {
+		sc      SpanContext
+		baggage Baggage
+		header  nats.Header
+	}
+	got := make(chan received, 1)
+	_, err := c.Sub("trace.orders", func(ctx context.Context, msg *nats.Msg) error {
+		sc, _ := SpanContextFromContext(ctx)
+		got <- received{sc: sc, baggage: BaggageFromContext(ctx), header: msg.Header}
+		return nil
+	})
+	require.NoError(t, err)
+
+	parent := SpanContext{TraceID: newTraceID(), SpanID: newSpanID(), Sampled: true, TraceState: "vendor=1"}
+	ctx := ContextWithSpanContext(context.Background(), parent)
+	ctx = ContextWithBaggage(ctx, Baggage{"tenant": "a"})
+	ctx = traceRequestID.ContextWithXRequestID(ctx, "req-1")
+	require.NoError(t, c.Pub(ctx, "trace.orders", nil, nil))
+
+	var r received
+	select {
+	case r = <-got:
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not handled")
+	}
+	assert.Equal(t, "req-1", r.header.Get("request_id"))
+	assert.Equal(t, "vendor=1", r.header.Get(HeaderTracestate))
+	assert.Equal(t, Baggage{"tenant": "a"}, r.baggage)
+	assert.Equal(t, parent.TraceID, r.sc.TraceID)
+
+	var spans []Span
+	require.Eventually(t, func() bool {
+		spans = exporter.Spans()
+		return len(spans) == 2
+	}, time.Second, 10*time.Millisecond)
+	var producer, consumer Span
+	for _, s := range spans {
+		if s.Kind == SpanKindProducer {
+			producer = s
+		} else {
+			consumer = s
+		}
+	}
+	assert.Equal(t, parent, producer.Parent)
+	assert.Equal(t, parent.TraceID, producer.SpanContext.TraceID)
+	assert.Equal(t, producer.SpanContext.Traceparent(), r.header.Get(HeaderTraceparent))
+	assert.Equal(t, "req-1", producer.Attributes["request_id"])
+
+	assert.Equal(t, SpanKindConsumer, consumer.Kind)
+	assert.Equal(t, r.sc, consumer.SpanContext)
+	assert.Equal(t, producer.SpanContext, consumer.Parent)
+	assert.Equal(t, []SpanContext{producer.SpanContext}, consumer.Links)
+	assert.Equal(t, "req-1", consumer.Attributes["request_id"])
+	assert.Equal(t, "trace.orders process", consumer.Name)
+
+	// a publish without a span starts a new trace
+	exporter.Reset()
+	require.NoError(t, c.Pub(context.Background(), "trace.orders", nil, nil))
+	r = <-got
+	assert.NotEqual(t, parent.TraceID, r.sc.TraceID)
+	assert.True(t, r.sc.IsValid())
+}
+
+func TestTraceContextOpenTelemetry(t *testing.T) {
+	c := newTestClient(t)
+	c.SetPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	got := make(chan context.Context, 1)
+	_, err := c.Sub("trace.otel", func(ctx context.Context, msg *nats.Msg) error {
+		got <- ctx
+		return nil
+	})
+	require.NoError(t, err)
+
+	// a publish inside an OpenTelemetry span, with OpenTelemetry baggage
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID(newTraceID()),
+		SpanID:     trace.SpanID(newSpanID()),
+		TraceFlags: trace.FlagsSampled,
+	})
+	member, err := baggage.NewMember("tenant", "a")
+	require.NoError(t, err)
+	bag, err := baggage.New(member)
+	require.NoError(t, err)
+	ctx := baggage.ContextWithBaggage(trace.ContextWithSpanContext(context.Background(), parent), bag)
+	ctx = ContextWithBaggage(ctx, Baggage{"user": "alice"})
+	require.NoError(t, c.Pub(ctx, "trace.otel", nil, nil))
+
+	var handled context.Context
+	select {
+	case handled = <-got:
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not handled")
+	}
+	consumer, ok := SpanContextFromContext(handled)
+	require.True(t, ok)
+	assert.Equal(t, TraceID(parent.TraceID()), consumer.TraceID)
+	// OpenTelemetry instrumented handlers continue from the consumer span
+	otelSpan := trace.SpanContextFromContext(handled)
+	assert.Equal(t, parent.TraceID(), otelSpan.TraceID())
+	assert.Equal(t, trace.SpanID(consumer.SpanID), otelSpan.SpanID())
+	assert.Equal(t, "a", baggage.FromContext(handled).Member("tenant").Value())
+	assert.Equal(t, Baggage{"tenant": "a", "user": "alice"}, BaggageFromContext(handled))
+}
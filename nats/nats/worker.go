@@ -0,0 +1,123 @@
+package nats
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// workerPool processes the messages of one subscription with a fixed number of goroutines.
+// dispatch blocks when the queue is full, so the messages wait in the subscription's
+// pending buffer, which is bounded by Config.PendingMsgsLimit and PendingBytesLimit.
+type workerPool struct {
+	queues   []chan *nats.Msg
+	orderKey string
+	dropped  func(msg *nats.Msg) // may be nil
+	wg       sync.WaitGroup
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// newWorkerPool starts workers running process. With orderKey every message with the same
+// header value goes to the same worker so they are processed in order, otherwise all workers share one queue.
+func newWorkerPool(workers, queueSize int, orderKey string, process func(msg *nats.Msg)) *workerPool {
+	if queueSize <= 0 {
+		queueSize = workers
+	}
+	p := &workerPool{orderKey: orderKey, done: make(chan struct{})}
+
+	if orderKey == "" {
+		queue := make(chan *nats.Msg, queueSize)
+		p.queues = []chan *nats.Msg{queue}
+		for i := 0; i < workers; i++ {
+			p.start(queue, process)
+		}
+		return p
+	}
+
+	size := queueSize / workers
+	if size < 1 {
+		size = 1
+	}
+	for i := 0; i < workers; i++ {
+		queue := make(chan *nats.Msg, size)
+		p.queues = append(p.queues, queue)
+		p.start(queue, process)
+	}
+	return p
+}
+
+func (p *workerPool) start(queue chan *nats.Msg, process func(msg *nats.Msg)) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for {
+			select {
+			case msg := <-queue:
+				process(msg)
+			case <-p.done:
+				// finish what is already queued
+				for {
+					select {
+					case msg := <-queue:
+						process(msg)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// dispatch queues msg, it blocks while the queue is full and drops msg once the pool is stopped
+func (p *workerPool) dispatch(msg *nats.Msg) {
+	queue := p.queues[0]
+	if len(p.queues) > 1 {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(msg.Header.Get(p.orderKey)))
+		queue = p.queues[h.Sum32()%uint32(len(p.queues))]
+	}
+	select {
+	case queue <- msg:
+	case <-p.done:
+		if p.dropped != nil {
+			p.dropped(msg)
+		}
+	}
+}
+
+// stop waits for the queued messages to be processed, it does nothing on a nil pool
+func (p *workerPool) stop() {
+	if p == nil {
+		return
+	}
+	p.stopOnce.Do(func() { close(p.done) })
+	p.wg.Wait()
+}
+
+// dispatcher returns the nats callback of channel, running process on a worker pool when channel.Workers > 1.
+// dropped, when not nil, is called for the messages received after the pool is stopped.
+func (c *Client) dispatcher(channel Channel, process, dropped func(msg *nats.Msg)) (func(msg *nats.Msg), *workerPool) {
+	if channel.Workers <= 1 {
+		return process, nil
+	}
+	p := newWorkerPool(channel.Workers, channel.QueueSize, channel.OrderKey, process)
+	p.dropped = dropped
+	c.poolsMu.Lock()
+	c.pools = append(c.pools, p)
+	c.poolsMu.Unlock()
+	return p.dispatch, p
+}
+
+// stopPools waits for every worker pool to finish its queued messages
+func (c *Client) stopPools() {
+	c.poolsMu.Lock()
+	pools := c.pools
+	c.pools = nil
+	c.poolsMu.Unlock()
+	for _, p := range pools {
+		p.stop()
+	}
+}
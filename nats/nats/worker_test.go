@@ -0,0 +1,129 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkersConcurrent(t *testing.T) {
+	c := newTestClient(t)
+
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	wg.Add(8)
+	_, err := c.Sub("jobs", func(ctx context.Context, msg *nats.Msg) error {
+		defer wg.Done()
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil
+	}, WithWorkers(4, 8))
+	require.NoError(t, err)
+
+	for i := 0; i < 8; i++ {
+		require.NoError(t, c.Pub(context.Background(), "jobs", nil, nil))
+	}
+	wg.Wait()
+	assert.Equal(t, int32(4), atomic.LoadInt32(&maxRunning))
+}
+
+func TestWorkersOrderKey(t *testing.T) {
+	c := newTestClient(t)
+
+	var mu sync.Mutex
+	got := map[string][]string{}
+	var wg sync.WaitGroup
+	wg.Add(30)
+	_, err := c.RegisterChannel([]Channel{{
+		ChannelName: "orders",
+		Workers:     4,
+		OrderKey:    "order_id",
+		Handler: func(ctx context.Context, msg *nats.Msg) error {
+			defer wg.Done()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			got[msg.Header.Get("order_id")] = append(got[msg.Header.Get("order_id")], string(msg.Data))
+			mu.Unlock()
+			return nil
+		},
+	}})
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		for _, id := range []string{"A", "B", "C"} {
+			require.NoError(t, c.Pub(context.Background(), "orders", map[string][]string{"order_id": {id}}, []byte(fmt.Sprint(i))))
+		}
+	}
+	wg.Wait()
+	for _, id := range []string{"A", "B", "C"} {
+		assert.Equal(t, []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}, got[id], id)
+	}
+}
+
+func TestWorkersDrainFinishesQueue(t *testing.T) {
+	c := newTestClient(t)
+	replies := subscribeRaw(t, c.natsConn.ConnectedUrl(), "jobs.done")
+
+	var handled int32
+	_, err := c.Sub("jobs", func(ctx context.Context, msg *nats.Msg) error {
+		time.Sleep(50 * time.Millisecond)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// the queued messages still publish while the client drains
+		if err := c.Pub(ctx, "jobs.done", nil, msg.Data); err != nil {
+			return err
+		}
+		atomic.AddInt32(&handled, 1)
+		return nil
+	}, WithWorkers(2, 10))
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, c.Pub(context.Background(), "jobs", nil, []byte(fmt.Sprint(i))))
+	}
+	require.NoError(t, c.natsConn.Flush())
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, c.Drain(ctx))
+	assert.Equal(t, int32(10), atomic.LoadInt32(&handled))
+	for i := 0; i < 10; i++ {
+		_, err := replies.NextMsg(time.Second)
+		require.NoError(t, err, "reply %d", i)
+	}
+}
+
+func TestWorkersStoppedWhenSubscribeFails(t *testing.T) {
+	c := newTestClient(t)
+	handler := func(ctx context.Context, msg *nats.Msg) error { return nil }
+
+	_, err := c.Sub("bad subject", handler, WithWorkers(2, 8))
+	require.Error(t, err)
+	_, err = c.RegisterChannel([]Channel{{ChannelName: "bad subject", GroupName: "g", Handler: handler, Workers: 2}})
+	require.Error(t, err)
+
+	require.Len(t, c.pools, 2)
+	for _, p := range c.pools {
+		select {
+		case <-p.done:
+		default:
+			t.Fatal("the pool of the failed subscription is still running")
+		}
+	}
+}
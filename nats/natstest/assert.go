@@ -0,0 +1,45 @@
+package natstest
+
+import (
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+
+	commonNats "github.com/siangyeh8818/commonTools/nats/nats"
+)
+
+// AssertHeader asserts that the key header of msg is want
+func AssertHeader(t assert.TestingT, msg *nats.Msg, key, want string) bool {
+	if h, ok := t.(interface{ Helper() }); ok {
+		h.Helper()
+	}
+	return assert.Equal(t, want, msg.Header.Get(key), "header %s of %s", key, msg.Subject)
+}
+
+// AssertHeaders asserts every header of want, other headers of msg are ignored
+func AssertHeaders(t assert.TestingT, msg *nats.Msg, want map[string]string) bool {
+	if h, ok := t.(interface{ Helper() }); ok {
+		h.Helper()
+	}
+	ok := true
+	for k, v := range want {
+		ok = AssertHeader(t, msg, k, v) && ok
+	}
+	return ok
+}
+
+// AssertTrace asserts that msg carries the request id, trace id and baggage of tr
+func AssertTrace(t assert.TestingT, msg *nats.Msg, tr Trace) bool {
+	if h, ok := t.(interface{ Helper() }); ok {
+		h.Helper()
+	}
+	ok := AssertHeader(t, msg, "request_id", tr.RequestID)
+	sc, err := commonNats.ParseTraceparent(msg.Header.Get(commonNats.HeaderTraceparent))
+	if !assert.NoError(t, err, "traceparent of %s", msg.Subject) {
+		return false
+	}
+	ok = assert.Equal(t, tr.SpanContext.TraceID, sc.TraceID, "trace id of %s", msg.Subject) && ok
+	if len(tr.Baggage) > 0 {
+		ok = assert.Equal(t, tr.Baggage, commonNats.ParseBaggage(msg.Header.Get(commonNats.HeaderBaggage)), "baggage of %s", msg.Subject) && ok
+	}
+	return ok
+}
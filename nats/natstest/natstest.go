@@ -0,0 +1,148 @@
+// Package natstest runs an embedded nats server with a ready nats.Client for hermetic tests of consumers and publishers.
+package natstest
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats-server/v2/server"
+
+	commonNats "github.com/siangyeh8818/commonTools/nats/nats"
+	traceRequestID "github.com/siangyeh8818/commonTools/trace/requestID"
+)
+
+// ReadyTimeout 等待 embedded server 可以連線的時間
+const ReadyTimeout = 10 * time.Second
+
+// Harness is an embedded server and a client connected to it, both stopped by t.Cleanup
+type Harness struct {
+	Server *server.Server
+	Client *commonNats.Client
+
+	t testing.TB
+}
+
+type options struct {
+	jetStream     bool
+	cfg           commonNats.Config
+	clientOptions []commonNats.Option
+}
+
+// Option configures Run
+type Option func(o *options)
+
+// WithJetStream enables JetStream on the server and the client, the store is a temporary directory
+func WithJetStream() Option {
+	return func(o *options) {
+		o.jetStream = true
+	}
+}
+
+// WithConfig is the base config of the client, Address is replaced by the embedded server url.
+// Streams and consumers in cfg.JetStream are provisioned when WithJetStream is set.
+func WithConfig(cfg commonNats.Config) Option {
+	return func(o *options) {
+		o.cfg = cfg
+	}
+}
+
+// WithClientOptions passes opts to nats.NewClient
+func WithClientOptions(opts ...commonNats.Option) Option {
+	return func(o *options) {
+		o.clientOptions = append(o.clientOptions, opts...)
+	}
+}
+
+// Run starts an embedded server on a random port and connects a client to it, it fails t on error
+func Run(t testing.TB, opts ...Option) *Harness {
+	t.Helper()
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	sOpts := &server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: o.jetStream,
+	}
+	if o.jetStream {
+		sOpts.StoreDir = t.TempDir()
+	}
+	s, err := server.NewServer(sOpts)
+	if err != nil {
+		t.Fatalf("natstest: fail to create server, err: %s", err.Error())
+	}
+	go s.Start()
+	t.Cleanup(s.Shutdown)
+	if !s.ReadyForConnections(ReadyTimeout) {
+		t.Fatalf("natstest: server not ready after %s", ReadyTimeout)
+	}
+
+	cfg := o.cfg
+	cfg.Address = []string{s.ClientURL()}
+	if cfg.Name == "" {
+		cfg.Name = t.Name()
+	}
+	if o.jetStream {
+		cfg.JetStream.Enabled = true
+	}
+	c, err := commonNats.NewClient(&cfg, o.clientOptions...)
+	if err != nil {
+		t.Fatalf("natstest: fail to create client, err: %s", err.Error())
+	}
+	t.Cleanup(func() { _ = c.Close(context.Background()) })
+
+	return &Harness{Server: s, Client: c, t: t}
+}
+
+// URL returns the client url of the embedded server, e.g. for other clients
+func (h *Harness) URL() string {
+	return h.Server.ClientURL()
+}
+
+// Trace is the trace context Publish sends with a message
+type Trace struct {
+	RequestID   string
+	SpanContext commonNats.SpanContext // parent of the producer span, the message carries its TraceID
+	Baggage     commonNats.Baggage
+}
+
+// NewTrace returns a sampled trace with a new request id and trace id
+func NewTrace() Trace {
+	sc := commonNats.SpanContext{Sampled: true}
+	_, _ = rand.Read(sc.TraceID[:])
+	_, _ = rand.Read(sc.SpanID[:])
+	return Trace{RequestID: uuid.New().String(), SpanContext: sc}
+}
+
+// Context returns ctx with the request id, span context and baggage of tr
+func (tr Trace) Context(ctx context.Context) context.Context {
+	ctx = traceRequestID.ContextWithXRequestID(ctx, tr.RequestID)
+	ctx = commonNats.ContextWithSpanContext(ctx, tr.SpanContext)
+	if len(tr.Baggage) > 0 {
+		ctx = commonNats.ContextWithBaggage(ctx, tr.Baggage)
+	}
+	return ctx
+}
+
+// Publish publishes data with a NewTrace through the client and returns the trace, it fails the test on error
+func (h *Harness) Publish(subject string, header map[string][]string, data []byte) Trace {
+	h.t.Helper()
+	tr := NewTrace()
+	h.PublishTrace(tr, subject, header, data)
+	return tr
+}
+
+// PublishTrace publishes data with the trace context of tr, it fails the test on error
+func (h *Harness) PublishTrace(tr Trace, subject string, header map[string][]string, data []byte) {
+	h.t.Helper()
+	if err := h.Client.Pub(tr.Context(context.Background()), subject, header, data); err != nil {
+		h.t.Fatalf("natstest: fail to publish to %s, err: %s", subject, err.Error())
+	}
+}
@@ -0,0 +1,68 @@
+package natstest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	commonNats "github.com/siangyeh8818/commonTools/nats/nats"
+)
+
+func TestHarness(t *testing.T) {
+	h := Run(t)
+	rec := h.Record("orders.>")
+
+	handled := make(chan string, 1)
+	_, err := h.Client.Sub("orders.created", func(ctx context.Context, msg *nats.Msg) error {
+		handled <- string(msg.Data)
+		return nil
+	})
+	require.NoError(t, err)
+
+	tr := NewTrace()
+	tr.Baggage = commonNats.Baggage{"tenant": "a"}
+	h.PublishTrace(tr, "orders.created", map[string][]string{"k": {"v"}}, []byte("1"))
+	second := h.Publish("orders.paid", nil, []byte("2"))
+
+	msgs := rec.Wait(2, 2*time.Second)
+	assert.Equal(t, "orders.created", msgs[0].Subject)
+	AssertTrace(t, msgs[0], tr)
+	AssertHeaders(t, msgs[0], map[string]string{"k": "v"})
+	AssertTrace(t, msgs[1], second)
+	assert.NotEqual(t, tr.SpanContext.TraceID, second.SpanContext.TraceID)
+	assert.Len(t, rec.Messages(), 2)
+
+	select {
+	case data := <-handled:
+		assert.Equal(t, "1", data)
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not handled")
+	}
+}
+
+func TestHarnessJetStream(t *testing.T) {
+	h := Run(t, WithJetStream(), WithConfig(commonNats.Config{
+		JetStream: commonNats.JetStreamConfig{
+			Streams: []commonNats.StreamConfig{{Name: "ORDERS", Subjects: []string{"orders.>"}, Storage: "memory"}},
+		},
+	}))
+	rec := h.Record("orders.created")
+
+	ack, err := h.Client.JSPub(NewTrace().Context(context.Background()), "orders.created", nil, []byte("1"))
+	require.NoError(t, err)
+	assert.Equal(t, "ORDERS", ack.Stream)
+	rec.Wait(1, 2*time.Second)
+}
+
+func TestHarnessClientOptions(t *testing.T) {
+	exporter := commonNats.NewInMemoryExporter()
+	h := Run(t, WithClientOptions(commonNats.WithSpanExporter(exporter)))
+	rec := h.Record("spans")
+	h.Publish("spans", nil, nil)
+	rec.Wait(1, 2*time.Second)
+	assert.Len(t, exporter.Spans(), 1)
+}
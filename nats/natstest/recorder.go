@@ -0,0 +1,78 @@
+package natstest
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Recorder keeps the messages received on a subject by its own connection, without the client middlewares
+type Recorder struct {
+	t    testing.TB
+	conn *nats.Conn
+
+	mu     sync.Mutex
+	msgs   []*nats.Msg
+	notify chan struct{} // closed and replaced on every message
+}
+
+// Record subscribes to subject, wildcards included, and records every message until the test ends
+func (h *Harness) Record(subject string) *Recorder {
+	h.t.Helper()
+	conn, err := nats.Connect(h.URL(), nats.Name(h.t.Name()+" recorder"))
+	if err != nil {
+		h.t.Fatalf("natstest: fail to connect recorder, err: %s", err.Error())
+	}
+	h.t.Cleanup(conn.Close)
+
+	r := &Recorder{t: h.t, conn: conn, notify: make(chan struct{})}
+	if _, err := conn.Subscribe(subject, r.add); err != nil {
+		h.t.Fatalf("natstest: fail to subscribe to %s, err: %s", subject, err.Error())
+	}
+	// the subscription is known by the server once the flush returns
+	if err := conn.Flush(); err != nil {
+		h.t.Fatalf("natstest: fail to flush recorder, err: %s", err.Error())
+	}
+	return r
+}
+
+func (r *Recorder) add(msg *nats.Msg) {
+	r.mu.Lock()
+	r.msgs = append(r.msgs, msg)
+	close(r.notify)
+	r.notify = make(chan struct{})
+	r.mu.Unlock()
+}
+
+// Messages returns the messages received so far
+func (r *Recorder) Messages() []*nats.Msg {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*nats.Msg(nil), r.msgs...)
+}
+
+// Wait waits until n messages are received and returns them, it fails the test after timeout
+func (r *Recorder) Wait(n int, timeout time.Duration) []*nats.Msg {
+	r.t.Helper()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		r.mu.Lock()
+		got, notify := len(r.msgs), r.notify
+		if got >= n {
+			msgs := append([]*nats.Msg(nil), r.msgs[:n]...)
+			r.mu.Unlock()
+			return msgs
+		}
+		r.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-deadline.C:
+			r.t.Fatalf("natstest: received %d of %d messages after %s", got, n, timeout)
+			return nil
+		}
+	}
+}